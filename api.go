@@ -0,0 +1,129 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/image-migration-dashboard/internal/auth"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+// scanAPI serves the endpoint for on-demand scans:
+//
+//	GET  /api/scan  reports the status of the running or most recent scan
+//	POST /api/scan  triggers a scan (requires a bearer token or a user with
+//	                scan access)
+type scanAPI struct {
+	Scanner *core.Scanner
+	// Static bearer token for triggering scans. If empty, only authenticated
+	// users can trigger scans.
+	Token string
+	// Only set if authentication is enabled.
+	Auth *auth.Authenticator
+	// Minimum time between two on-demand scans.
+	MinInterval time.Duration
+	// Only set if leader election is enabled. Scans can only be triggered on
+	// the leader.
+	IsLeader func() bool
+
+	mutex         sync.Mutex
+	lastTriggered time.Time
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (a *scanAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if a.Auth != nil && !a.authorizeUser(w, r, auth.AccessView) {
+			return
+		}
+		respondwith.JSON(w, http.StatusOK, a.Scanner.Status())
+	case http.MethodPost:
+		a.triggerScan(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorizeUser checks whether the request comes from an authenticated user
+// with the given access, and writes an error response otherwise.
+func (a *scanAPI) authorizeUser(w http.ResponseWriter, r *http.Request, access auth.Access) bool {
+	user, err := a.Auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !user.Can(access, a.Auth.Config.Access) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (a *scanAPI) triggerScan(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1:
+		//ok
+	case a.Auth != nil:
+		if !a.authorizeUser(w, r, auth.AccessScan) {
+			return
+		}
+	case a.Token == "":
+		http.Error(w, "on-demand scans are not enabled", http.StatusForbidden)
+		return
+	default:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if a.IsLeader != nil && !a.IsLeader() {
+		http.Error(w, "this replica is not the leader, please retry later", http.StatusServiceUnavailable)
+		return
+	}
+
+	//requests during a running scan are answered with the running scan and do
+	//not count against the rate limit
+	status := a.Scanner.Status()
+	if status.Running {
+		respondwith.JSON(w, http.StatusAccepted, status)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if wait := a.MinInterval - time.Since(a.lastTriggered); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many scan requests, please retry later", http.StatusTooManyRequests)
+		return
+	}
+	status, started := a.Scanner.Trigger("api")
+	if started {
+		a.lastTriggered = time.Now()
+		logg.Info("on-demand scan triggered by %s", r.RemoteAddr)
+	}
+	respondwith.JSON(w, http.StatusAccepted, status)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func newTestScanAPI(t *testing.T, token string) *scanAPI {
+	t.Helper()
+	clientset, err := core.NewFixtureClientset("internal/core/testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	testDB := &core.Database{
+		DailyResults: make(map[string]core.ScanResult),
+		Storage:      &core.MemoryStorage{},
+	}
+	return &scanAPI{
+		Scanner:     core.NewScanner(context.Background(), testDB, clientset),
+		Token:       token,
+		MinInterval: time.Hour,
+	}
+}
+
+func doScanRequest(api *scanAPI, method, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/scan", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestScanAPI(t *testing.T) {
+	api := newTestScanAPI(t, "secret")
+
+	assert.DeepEqual(t, "without token", doScanRequest(api, http.MethodPost, "").Code, http.StatusUnauthorized)
+	assert.DeepEqual(t, "with wrong token", doScanRequest(api, http.MethodPost, "wrong").Code, http.StatusUnauthorized)
+
+	assert.DeepEqual(t, "first scan", doScanRequest(api, http.MethodPost, "secret").Code, http.StatusAccepted)
+	api.Scanner.Wait()
+
+	rec := doScanRequest(api, http.MethodPost, "secret")
+	assert.DeepEqual(t, "second scan", rec.Code, http.StatusTooManyRequests)
+	assert.DeepEqual(t, "Retry-After", rec.Header().Get("Retry-After"), "3600")
+
+	rec = doScanRequest(api, http.MethodGet, "")
+	assert.DeepEqual(t, "status", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "status content type", rec.Header().Get("Content-Type"), "application/json")
+
+	assert.DeepEqual(t, "wrong method", doScanRequest(api, http.MethodDelete, "secret").Code, http.StatusMethodNotAllowed)
+}
+
+func TestScanAPIDisabled(t *testing.T) {
+	api := newTestScanAPI(t, "")
+	assert.DeepEqual(t, "disabled", doScanRequest(api, http.MethodPost, "").Code, http.StatusForbidden)
+	assert.DeepEqual(t, "status", doScanRequest(api, http.MethodGet, "").Code, http.StatusOK)
+}
+
+func TestScanAPIFollower(t *testing.T) {
+	api := newTestScanAPI(t, "secret")
+	leader := false
+	api.IsLeader = func() bool { return leader }
+	assert.DeepEqual(t, "on follower", doScanRequest(api, http.MethodPost, "secret").Code, http.StatusServiceUnavailable)
+	assert.DeepEqual(t, "status on follower", doScanRequest(api, http.MethodGet, "").Code, http.StatusOK)
+	leader = true
+	assert.DeepEqual(t, "on leader", doScanRequest(api, http.MethodPost, "secret").Code, http.StatusAccepted)
+	api.Scanner.Wait()
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [options] <file>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Writes all scans from Swift (scan results, the image report and the raw data) into a")
+		fmt.Fprintln(fs.Output(), "tar archive. Use \"-\" as the file to write the archive to stdout.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	configFlags := registerConfigFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := configFlags.load()
+	fatalIfErr(err)
+	storage, err := core.NewSwiftStorage(cfg.Swift)
+	fatalIfErr(err)
+
+	fileName := fs.Arg(0)
+	var stats core.ArchiveStats
+	if fileName == "-" {
+		stats, err = core.ExportArchive(os.Stdout, storage, time.Now())
+	} else {
+		stats, err = exportToFile(fileName, storage)
+	}
+	fatalIfErr(err)
+	//stdout may contain the archive
+	fmt.Fprintf(os.Stderr, "%d scans exported, %d with raw data\n", stats.Scans, stats.RawScans)
+}
+
+// exportToFile writes the archive into the given file, which is removed if
+// the archive cannot be written completely.
+func exportToFile(fileName string, storage core.Storage) (core.ArchiveStats, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return core.ArchiveStats{}, err
+	}
+	stats, err := core.ExportArchive(file, storage, time.Now())
+	//closing the file may report a failed write
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+	}
+	return stats, err
+}
+
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [--mode merge|replace] [options] <file>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Loads a tar archive written by the export command into Swift. The archive is validated")
+		fmt.Fprintln(fs.Output(), "completely before any data is written.")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "If leader election is configured, the leader lease is held while the scans are written, so")
+		fmt.Fprintln(fs.Output(), "that no replica of the dashboard writes to Swift at the same time. Otherwise, stop the")
+		fmt.Fprintln(fs.Output(), "dashboard first.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	mode := fs.String("mode", string(core.ImportMerge),
+		`"merge" keeps existing scans unless the archive has a newer scan for the same date, "replace" deletes all scans that are not in the archive after the import`)
+	leaseTimeout := fs.Duration("lease-timeout", time.Minute,
+		"maximum time to wait for the leader lease (only if leader election is configured)")
+	kubeFlags := registerKubeFlags(fs)
+	configFlags := registerConfigFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch core.ImportMode(*mode) {
+	case core.ImportMerge, core.ImportReplace:
+	default:
+		fatalIfErr(fmt.Errorf(`invalid value for --mode: expected "merge" or "replace", got %q`, *mode))
+	}
+
+	cfg, err := configFlags.load()
+	fatalIfErr(err)
+	storage, err := core.NewSwiftStorage(cfg.Swift)
+	fatalIfErr(err)
+
+	//the archive is read twice, so it cannot come from stdin
+	fileName := fs.Arg(0)
+	open := func() (io.ReadCloser, error) { return os.Open(fileName) }
+	release, err := acquireLeaseIfConfigured(cfg, kubeFlags, "import", *leaseTimeout)
+	fatalIfErr(err)
+	stats, err := core.ImportArchive(context.Background(), storage, open, core.ImportMode(*mode))
+	release()
+	fatalIfErr(err)
+	fmt.Printf("%d scans imported, %d with raw data, %d skipped since newer scans exist\n", stats.Scans, stats.RawScans, stats.Skipped)
+}
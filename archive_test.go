@@ -0,0 +1,63 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+// brokenStorage is a MemoryStorage that cannot be loaded.
+type brokenStorage struct {
+	*core.MemoryStorage
+}
+
+func (brokenStorage) Load(db *core.Database) error {
+	return errors.New("storage unavailable")
+}
+
+func TestExportToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-migration-dashboard")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "backup.tar")
+	stats, err := exportToFile(fileName, &core.MemoryStorage{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "export stats", stats, core.ArchiveStats{})
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("expected archive to exist: %s", err.Error())
+	}
+
+	//an incomplete archive is removed
+	fileName = filepath.Join(dir, "broken.tar")
+	_, err = exportToFile(fileName, brokenStorage{&core.MemoryStorage{}})
+	if err == nil {
+		t.Fatal("expected export to fail")
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("expected incomplete archive to be removed, got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check --policy <file> [options] [<dir-or-file>...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Checks the images in YAML/JSON manifests (or in a report from \"scan-manifests --format json\")")
+		fmt.Fprintln(fs.Output(), "against a policy. Exits with status 1 if there are violations that are not in the baseline.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	policyPath := fs.String("policy", "", "path to the policy file (YAML or JSON)")
+	baselinePath := fs.String("baseline", "", "(optional) path to a baseline file with grandfathered violations")
+	updateBaseline := fs.Bool("update-baseline", false, "write all current violations into the baseline file instead of checking")
+	reportPath := fs.String("report", "", "(optional) path to an image report in JSON format, instead of scanning manifests")
+	namespace := fs.String("namespace", "default", "namespace for objects in manifests that do not specify one")
+	format := fs.String("format", "text", "output format (\"text\" or \"json\")")
+	skipInvalid := fs.Bool("skip-invalid", false, "skip manifest files that cannot be parsed instead of failing (these are not checked)")
+	fs.Parse(args)
+
+	if *policyPath == "" || (*reportPath == "") == (fs.NArg() == 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *updateBaseline && *baselinePath == "" {
+		logg.Fatal("--update-baseline requires --baseline")
+	}
+	if *format != "text" && *format != "json" {
+		logg.Fatal("unknown output format: %q", *format)
+	}
+
+	policy, err := core.ReadPolicy(*policyPath)
+	fatalIfErr(err)
+
+	var report core.ImageReport
+	if *reportPath != "" {
+		report, err = readImageReport(*reportPath)
+	} else {
+		report, err = core.ScanManifests(fs.Args(), *namespace, *skipInvalid)
+	}
+	fatalIfErr(err)
+
+	violations := policy.Check(report)
+	if *updateBaseline {
+		f, err := os.Create(*baselinePath)
+		fatalIfErr(err)
+		err = printJSON(f, core.NewBaseline(violations))
+		fatalIfErr(err)
+		fatalIfErr(f.Close())
+		logg.Info("wrote %d violations into %s", len(violations), *baselinePath)
+		return
+	}
+
+	var baseline core.Baseline
+	if *baselinePath != "" {
+		baseline, err = core.ReadBaseline(*baselinePath)
+		fatalIfErr(err)
+	}
+	newViolations, knownViolations := baseline.Filter(violations)
+
+	if *format == "json" {
+		err = printJSON(os.Stdout, struct {
+			Violations      []core.Violation `json:"violations"`
+			KnownViolations []core.Violation `json:"grandfathered_violations"`
+		}{newViolations, knownViolations})
+	} else {
+		err = printViolations(os.Stdout, newViolations, knownViolations)
+	}
+	fatalIfErr(err)
+
+	if len(newViolations) > 0 {
+		os.Exit(1)
+	}
+}
+
+// readImageReport reads an image report in the format produced by
+// "scan-manifests --format json". The format of the "image_data" object in
+// Swift is accepted as well.
+func readImageReport(path string) (core.ImageReport, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return core.ImageReport{}, err
+	}
+	var data struct {
+		Images *core.ImageReport `json:"images"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err == nil && data.Images != nil {
+		return *data.Images, nil
+	}
+	var report core.ImageReport
+	err = json.Unmarshal(b, &report)
+	if err != nil {
+		return core.ImageReport{}, fmt.Errorf("could not parse image report %s: %s", path, err.Error())
+	}
+	return report, nil
+}
+
+func printViolations(w io.Writer, newViolations, knownViolations []core.Violation) error {
+	if len(newViolations) == 0 {
+		_, err := fmt.Fprintln(w, "No policy violations found.")
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := fmt.Fprintf(w, "%d policy violations found:\n", len(newViolations))
+		if err != nil {
+			return err
+		}
+		for _, v := range newViolations {
+			_, err := fmt.Fprintf(w, "\n  %s\n    image:    %s (from %s)\n    violates: %s\n",
+				v.Container, v.Image, v.Registry.DisplayName(), v.Rule)
+			if err != nil {
+				return err
+			}
+			if v.Source != "" {
+				_, err := fmt.Fprintf(w, "    found in: %s\n", v.Source)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(knownViolations) > 0 {
+		_, err := fmt.Fprintf(w, "\n%d further violations are grandfathered by the baseline.\n", len(knownViolations))
+		return err
+	}
+	return nil
+}
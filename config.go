@@ -0,0 +1,355 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/image-migration-dashboard/internal/auth"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+	"sigs.k8s.io/yaml"
+)
+
+// Configuration contains the settings of the dashboard server. Each setting
+// can be given in the configuration file, as an environment variable, or as a
+// command-line flag, with later sources taking precedence.
+type Configuration struct {
+	ListenAddress string `json:"listen_address"`
+	// When shutting down, a running scan gets this much time to finish and
+	// save its result.
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+	TLS             struct {
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+	} `json:"tls"`
+	Scan struct {
+		// How often the collector checks whether a scan is due.
+		CheckInterval duration `json:"check_interval"`
+		// A scan is due when the last successful scan is older than this.
+		Interval duration `json:"interval"`
+		// The data on the dashboard is shown as stale after this.
+		StaleAfter duration `json:"stale_after"`
+		// How often replicas that do not scan (followers and viewers) re-read
+		// the history from storage.
+		RefreshInterval duration `json:"refresh_interval"`
+	} `json:"scan"`
+	Health struct {
+		// The dashboard is reported as not ready after this many consecutive
+		// failed scan attempts or uploads. Zero disables this check.
+		MaxFailures int `json:"max_failures"`
+	} `json:"health"`
+	// If LeaseName is set, only the replica that holds this Lease scans the
+	// cluster and writes to Swift. The other replicas serve the history from
+	// Swift.
+	LeaderElection struct {
+		LeaseName     string   `json:"lease_name"`
+		Namespace     string   `json:"namespace"`
+		LeaseDuration duration `json:"lease_duration"`
+		RenewDeadline duration `json:"renew_deadline"`
+		RetryPeriod   duration `json:"retry_period"`
+	} `json:"leader_election"`
+	Swift core.SwiftOptions `json:"swift"`
+	// If not empty, scan results are kept in this directory until they have
+	// been uploaded to Swift.
+	SpoolDir string      `json:"spool_dir"`
+	Auth     auth.Config `json:"auth"`
+}
+
+// defaultConfiguration returns the configuration that is used for all
+// settings that are not given explicitly.
+func defaultConfiguration() Configuration {
+	var cfg Configuration
+	cfg.ListenAddress = ":80"
+	cfg.ShutdownTimeout = duration(time.Minute)
+	cfg.Scan.CheckInterval = duration(30 * time.Minute)
+	cfg.Scan.Interval = duration(6 * time.Hour)
+	cfg.Scan.StaleAfter = duration(12 * time.Hour)
+	cfg.Scan.RefreshInterval = duration(5 * time.Minute)
+	cfg.Health.MaxFailures = 3
+	cfg.LeaderElection.LeaseDuration = duration(15 * time.Second)
+	cfg.LeaderElection.RenewDeadline = duration(10 * time.Second)
+	cfg.LeaderElection.RetryPeriod = duration(2 * time.Second)
+	cfg.Swift = core.DefaultSwiftOptions()
+	//if authentication is enabled, all users may see the dashboard by default
+	cfg.Auth.Access = map[auth.Access][]string{auth.AccessView: {auth.AnyRole}}
+	return cfg
+}
+
+// configSetting describes a setting that can be overridden by a flag and an
+// environment variable.
+type configSetting struct {
+	Flag  string
+	Usage string
+	// Returns a pointer to the setting's field: *string, *int or *duration.
+	Field func(cfg *Configuration) interface{}
+}
+
+var configSettings = []configSetting{
+	{"listen-address", "address for serving the dashboard",
+		func(cfg *Configuration) interface{} { return &cfg.ListenAddress }},
+	{"shutdown-timeout", "maximum time for a running scan to finish and save its result when shutting down",
+		func(cfg *Configuration) interface{} { return &cfg.ShutdownTimeout }},
+	{"tls-cert", "(optional) path to a TLS certificate for serving the dashboard via HTTPS",
+		func(cfg *Configuration) interface{} { return &cfg.TLS.CertFile }},
+	{"tls-key", "(optional) path to the TLS private key for serving the dashboard via HTTPS",
+		func(cfg *Configuration) interface{} { return &cfg.TLS.KeyFile }},
+	{"scan-check-interval", "how often to check whether a cluster scan is due",
+		func(cfg *Configuration) interface{} { return &cfg.Scan.CheckInterval }},
+	{"scan-interval", "maximum age of the last successful cluster scan before a new scan is done",
+		func(cfg *Configuration) interface{} { return &cfg.Scan.Interval }},
+	{"stale-after", "age after which the data on the dashboard is shown as stale",
+		func(cfg *Configuration) interface{} { return &cfg.Scan.StaleAfter }},
+	{"scan-refresh-interval", "how often replicas that do not scan (followers and viewers) re-read the history from Swift",
+		func(cfg *Configuration) interface{} { return &cfg.Scan.RefreshInterval }},
+	{"health-max-failures", "number of consecutive failed scan attempts or uploads after which the dashboard is not ready (0 = never)",
+		func(cfg *Configuration) interface{} { return &cfg.Health.MaxFailures }},
+	{"leader-election-lease", "(optional) name of the Lease for electing the replica that scans the cluster; all replicas scan if empty",
+		func(cfg *Configuration) interface{} { return &cfg.LeaderElection.LeaseName }},
+	{"leader-election-namespace", "namespace of the Lease for leader election",
+		func(cfg *Configuration) interface{} { return &cfg.LeaderElection.Namespace }},
+	{"swift-container", "name of the Swift container for storing scan results",
+		func(cfg *Configuration) interface{} { return &cfg.Swift.Container }},
+	{"swift-scan-result-prefix", "prefix for the names of scan result objects in Swift",
+		func(cfg *Configuration) interface{} { return &cfg.Swift.ScanResultPrefix }},
+	{"swift-image-data-object", "name of the object with the image data in Swift",
+		func(cfg *Configuration) interface{} { return &cfg.Swift.ImageDataObject }},
+	{"swift-raw-data-prefix", "prefix for the names of the objects with the raw data of each scan in Swift",
+		func(cfg *Configuration) interface{} { return &cfg.Swift.RawDataPrefix }},
+	{"spool-dir", "(optional) directory for keeping scan results until they have been uploaded to Swift",
+		func(cfg *Configuration) interface{} { return &cfg.SpoolDir }},
+}
+
+func (s configSetting) get(cfg *Configuration) string {
+	switch field := s.Field(cfg).(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *duration:
+		return field.String()
+	default:
+		panic(fmt.Sprintf("unexpected field type %T", field))
+	}
+}
+
+func (s configSetting) set(cfg *Configuration, value string) error {
+	switch field := s.Field(cfg).(type) {
+	case *string:
+		*field = value
+		return nil
+	case *int:
+		var err error
+		*field, err = strconv.Atoi(value)
+		return err
+	case *duration:
+		return field.parse(value)
+	default:
+		panic(fmt.Sprintf("unexpected field type %T", field))
+	}
+}
+
+// envVarName returns the name of the environment variable for a setting.
+func (s configSetting) envVarName() string {
+	return "IMAGE_MIGRATION_DASHBOARD_" + strings.ToUpper(strings.Replace(s.Flag, "-", "_", -1))
+}
+
+// configFlags holds the configuration flags of a FlagSet.
+type configFlags struct {
+	flagSet *flag.FlagSet
+	path    *string
+	values  map[string]*string
+}
+
+// registerConfigFlags registers the flags for the configuration file and for
+// all settings in the given FlagSet.
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{
+		flagSet: fs,
+		path:    fs.String("config", "", "(optional) path to a configuration file (YAML or JSON)"),
+		values:  make(map[string]*string),
+	}
+	defaults := defaultConfiguration()
+	for _, s := range configSettings {
+		usage := fmt.Sprintf("%s (env: %s)", s.Usage, s.envVarName())
+		if def := s.get(&defaults); def != "" {
+			usage += fmt.Sprintf(" (default %q)", def)
+		}
+		//the default is applied in load(), so that we can tell whether the flag
+		//was given
+		cf.values[s.Flag] = fs.String(s.Flag, "", usage)
+	}
+	return cf
+}
+
+// load builds the effective configuration from the defaults, the
+// configuration file, the environment and the flags, and validates it.
+func (cf *configFlags) load() (Configuration, error) {
+	cfg := defaultConfiguration()
+	if *cf.path != "" {
+		buf, err := ioutil.ReadFile(*cf.path)
+		if err != nil {
+			return cfg, fmt.Errorf("could not read configuration: %s", err.Error())
+		}
+		err = yaml.UnmarshalStrict(buf, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("could not parse configuration in %s: %s", *cf.path, err.Error())
+		}
+	}
+
+	if cfg.Auth.OIDC != nil {
+		cfg.Auth.OIDC.ClientSecret = os.Getenv("IMAGE_MIGRATION_DASHBOARD_OIDC_CLIENT_SECRET")
+		cfg.Auth.OIDC.SessionKey = os.Getenv("IMAGE_MIGRATION_DASHBOARD_SESSION_KEY")
+	}
+	for _, s := range configSettings {
+		if value := os.Getenv(s.envVarName()); value != "" {
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("invalid value for %s: %s", s.envVarName(), err.Error())
+			}
+		}
+	}
+	given := make(map[string]bool)
+	cf.flagSet.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, s := range configSettings {
+		if given[s.Flag] {
+			if err := s.set(&cfg, *cf.values[s.Flag]); err != nil {
+				return cfg, fmt.Errorf("invalid value for --%s: %s", s.Flag, err.Error())
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks the configuration for consistency, and reports all problems
+// at once.
+func (cfg Configuration) validate() error {
+	var errs []string
+	complain := func(msg string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(msg, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		complain("listen_address %q is not a valid address: %s", cfg.ListenAddress, err.Error())
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		complain("tls.cert_file and tls.key_file must be given together")
+	}
+	for _, path := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			complain("cannot read TLS file: %s", err.Error())
+		}
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		complain("shutdown_timeout must not be negative")
+	}
+	if cfg.Scan.CheckInterval <= 0 {
+		complain("scan.check_interval must be positive")
+	}
+	if cfg.Scan.Interval < cfg.Scan.CheckInterval {
+		complain("scan.interval (%s) must not be shorter than scan.check_interval (%s)", cfg.Scan.Interval, cfg.Scan.CheckInterval)
+	}
+	if cfg.Scan.StaleAfter < cfg.Scan.Interval {
+		complain("scan.stale_after (%s) must not be shorter than scan.interval (%s)", cfg.Scan.StaleAfter, cfg.Scan.Interval)
+	}
+	if cfg.Scan.RefreshInterval <= 0 {
+		complain("scan.refresh_interval must be positive")
+	}
+	if cfg.Health.MaxFailures < 0 {
+		complain("health.max_failures must not be negative")
+	}
+
+	if le := cfg.LeaderElection; le.LeaseName != "" {
+		if le.Namespace == "" {
+			complain("leader_election.namespace is required if leader_election.lease_name is given")
+		}
+		//same rules as in client-go, which uses a jitter factor of 1.2
+		if le.RenewDeadline <= le.RetryPeriod*6/5 || le.RetryPeriod <= 0 {
+			complain("leader_election.renew_deadline (%s) must be longer than 1.2 times leader_election.retry_period (%s), which must be positive",
+				le.RenewDeadline, le.RetryPeriod)
+		}
+		if le.LeaseDuration <= le.RenewDeadline {
+			complain("leader_election.lease_duration (%s) must be longer than leader_election.renew_deadline (%s)", le.LeaseDuration, le.RenewDeadline)
+		}
+	}
+
+	if err := cfg.Swift.Validate(); err != nil {
+		complain("swift: %s", err.Error())
+	}
+	if err := cfg.Auth.Validate(); err != nil {
+		complain("auth: %s", err.Error())
+	}
+	//with a random key per replica, sessions would only be valid on the
+	//replica that the user logged in on
+	if cfg.LeaderElection.LeaseName != "" && cfg.Auth.OIDC != nil && cfg.Auth.OIDC.SessionKey == "" {
+		complain("$IMAGE_MIGRATION_DASHBOARD_SESSION_KEY is required if leader_election.lease_name and auth.oidc are given")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// handleGetConfig serves the effective configuration for debugging.
+func handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	respondwith.JSON(w, http.StatusOK, config)
+}
+
+// duration is a time.Duration that is given as a string like "30m" in the
+// configuration file.
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *duration) UnmarshalJSON(buf []byte) error {
+	var value string
+	err := json.Unmarshal(buf, &value)
+	if err != nil {
+		return err
+	}
+	return d.parse(value)
+}
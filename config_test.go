@@ -0,0 +1,92 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func loadTestConfig(t *testing.T, args ...string) (Configuration, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := registerConfigFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return cf.load()
+}
+
+func TestConfigurationPrecedence(t *testing.T) {
+	os.Setenv("IMAGE_MIGRATION_DASHBOARD_STALE_AFTER", "10h")
+	os.Setenv("IMAGE_MIGRATION_DASHBOARD_SCAN_INTERVAL", "2h")
+	defer os.Unsetenv("IMAGE_MIGRATION_DASHBOARD_STALE_AFTER")
+	defer os.Unsetenv("IMAGE_MIGRATION_DASHBOARD_SCAN_INTERVAL")
+
+	cfg, err := loadTestConfig(t, "--config", "testdata/config.yaml", "--scan-interval", "4h", "--health-max-failures", "5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := defaultConfiguration()
+	expected.ListenAddress = ":8080"                               // from file
+	expected.Swift.Container = "image-migration-dashboard-staging" // from file
+	expected.Scan.StaleAfter = duration(10 * time.Hour)            // env overrides file
+	expected.Scan.Interval = duration(4 * time.Hour)               // flag overrides env and file
+	expected.Health.MaxFailures = 5                                // from flag
+	assert.DeepEqual(t, "configuration", cfg, expected)
+}
+
+func TestConfigurationValidation(t *testing.T) {
+	_, err := loadTestConfig(t, "--listen-address", "localhost", "--tls-cert", "testdata/config.yaml",
+		"--scan-interval", "10m", "--swift-image-data-object", "scan-result/images", "--health-max-failures", "-1",
+		"--leader-election-lease", "image-migration-dashboard")
+	if err == nil {
+		t.Fatal("expected configuration to be invalid")
+	}
+	for _, msg := range []string{
+		`listen_address "localhost" is not a valid address`,
+		"tls.cert_file and tls.key_file must be given together",
+		"scan.interval (10m0s) must not be shorter than scan.check_interval (30m0s)",
+		"health.max_failures must not be negative",
+		"leader_election.namespace is required if leader_election.lease_name is given",
+		`swift: image data object "scan-result/images" may not be below the scan result prefix`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected error to contain %q, got: %s", msg, err.Error())
+		}
+	}
+
+	//all replicas need the same session key
+	_, err = loadTestConfig(t, "--config", "testdata/config-oidc.yaml")
+	assert.DeepEqual(t, "missing session key", err.Error(),
+		"invalid configuration: $IMAGE_MIGRATION_DASHBOARD_SESSION_KEY is required if leader_election.lease_name and auth.oidc are given")
+	os.Setenv("IMAGE_MIGRATION_DASHBOARD_SESSION_KEY", "0123456789abcdef0123456789abcdef")
+	defer os.Unsetenv("IMAGE_MIGRATION_DASHBOARD_SESSION_KEY")
+	cfg, err := loadTestConfig(t, "--config", "testdata/config-oidc.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "session key", cfg.Auth.OIDC.SessionKey, "0123456789abcdef0123456789abcdef")
+
+	_, err = loadTestConfig(t, "--stale-after", "soon")
+	assert.DeepEqual(t, "invalid duration", err.Error(), `invalid value for --stale-after: time: invalid duration "soon"`)
+}
@@ -4,14 +4,22 @@ go 1.14
 
 require (
 	github.com/blend/go-sdk v1.1.1 // indirect
+	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/gophercloud/gophercloud v0.6.1-0.20191122030953-d8ac278c1c9d
 	github.com/gophercloud/utils v0.0.0-20200331031917-67709f524c24
 	github.com/jpillora/longestcommon v0.0.0-20161227235612-adb9d91ee629 // indirect
 	github.com/majewsky/schwift v0.0.0-20200224150542-3857990bb9f7
+	github.com/pquerna/cachecontrol v0.2.0 // indirect
+	github.com/prometheus/client_golang v1.2.1
 	github.com/sapcc/go-bits v0.0.0-20200408113334-fba3bcbf66ea
 	github.com/wcharczuk/go-chart v2.0.2-0.20191206192251-962b9abdec2b+incompatible
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1 // indirect
-	k8s.io/apimachinery v0.15.9
-	k8s.io/client-go v0.15.9
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	gopkg.in/square/go-jose.v2 v2.6.0
+	k8s.io/api v0.18.19
+	k8s.io/apimachinery v0.18.19
+	k8s.io/client-go v0.18.19
+	k8s.io/kube-openapi v0.0.0-20200410163147-594e756bea31 // indirect
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,45 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+// handleHealthz serves the liveness probe. It fails if the collector is
+// wedged.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := db.Health(config.Health.MaxFailures, time.Now())
+	respondWithHealth(w, report.Alive, report)
+}
+
+// handleReadyz serves the readiness probe. It fails until the history was
+// loaded from storage, and after too many consecutive failed scans or
+// uploads.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := db.Health(config.Health.MaxFailures, time.Now())
+	respondWithHealth(w, report.Ready, report)
+}
+
+func respondWithHealth(w http.ResponseWriter, ok bool, report interface{}) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	respondwith.JSON(w, code, report)
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth implements optional authentication for the dashboard, either
+// through an OIDC login flow (for browsers) or through OpenStack Keystone
+// tokens (for API clients).
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Access is a level of access to the dashboard.
+type Access string
+
+// Acceptable values for Access.
+const (
+	// AccessView allows to see the dashboard and the scan status.
+	AccessView Access = "view"
+	// AccessScan allows to trigger on-demand scans.
+	AccessScan Access = "scan"
+	// AccessDebug allows to see debug information, e.g. the configuration.
+	AccessDebug Access = "debug"
+)
+
+// AnyRole can be given in an access rule to grant access to all
+// authenticated users.
+const AnyRole = "*"
+
+// Config contains the configuration for authentication. Authentication is
+// disabled unless OIDC and/or Keystone are configured.
+type Config struct {
+	OIDC     *OIDCConfig     `json:"oidc,omitempty"`
+	Keystone *KeystoneConfig `json:"keystone,omitempty"`
+	// Maps each access level to the roles that are granted this access. For
+	// OIDC, roles are taken from a claim in the ID token; for Keystone, roles
+	// are the role names in the token's scope.
+	Access map[Access][]string `json:"access,omitempty"`
+	// If true, users only see the details of namespaces in which they may list
+	// pods according to Kubernetes RBAC. Cluster-wide totals are always shown.
+	NamespaceRBAC bool `json:"namespace_rbac,omitempty"`
+}
+
+// Enabled checks whether authentication is enabled.
+func (c Config) Enabled() bool {
+	return c.OIDC != nil || c.Keystone != nil
+}
+
+// Validate checks the configuration for consistency.
+func (c Config) Validate() error {
+	for access := range c.Access {
+		switch access {
+		case AccessView, AccessScan, AccessDebug:
+		default:
+			return fmt.Errorf("unknown access level %q (expected \"view\", \"scan\" or \"debug\")", access)
+		}
+	}
+	if c.NamespaceRBAC && !c.Enabled() {
+		return errors.New("namespace_rbac requires oidc or keystone to be configured")
+	}
+	if c.OIDC != nil {
+		err := c.OIDC.validate()
+		if err != nil {
+			return fmt.Errorf("oidc: %s", err.Error())
+		}
+	}
+	if c.Keystone != nil {
+		err := c.Keystone.validate()
+		if err != nil {
+			return fmt.Errorf("keystone: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// User is an authenticated user.
+type User struct {
+	Name  string
+	Roles []string
+	// How the user was authenticated: "oidc" or "keystone".
+	Method string
+}
+
+// Can checks whether the user has the given access according to the given
+// access rules.
+func (u User) Can(access Access, rules map[Access][]string) bool {
+	for _, allowed := range rules[access] {
+		if allowed == AnyRole {
+			return true
+		}
+		for _, role := range u.Roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// UserFromContext returns the user that was authenticated by
+// Authenticator.Require, or nil if authentication is disabled.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(contextKey{}).(*User)
+	return user
+}
+
+// errUnauthenticated is returned by Authenticate when the request does not
+// carry any credentials.
+var errUnauthenticated = errors.New("not authenticated")
+
+// Authenticator authenticates requests with the configured methods.
+type Authenticator struct {
+	Config   Config
+	oidc     *oidcProvider
+	keystone *keystoneValidator
+	sessions *sessionCodec
+}
+
+// NewAuthenticator prepares the configured authentication methods. If OIDC is
+// enabled, the provider's configuration is discovered. The identity client is
+// only needed if Keystone is enabled. Sessions are signed with the given key,
+// or with a random key if it is empty.
+func NewAuthenticator(ctx context.Context, cfg Config, identity *gophercloud.ServiceClient, sessionKey []byte) (*Authenticator, error) {
+	a := &Authenticator{Config: cfg}
+	if cfg.OIDC != nil {
+		var err error
+		a.oidc, err = newOIDCProvider(ctx, *cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		a.sessions, err = newSessionCodec(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Keystone != nil {
+		if identity == nil {
+			return nil, errors.New("Keystone authentication requires an identity client")
+		}
+		a.keystone = newKeystoneValidator(*cfg.Keystone, identity)
+	}
+	return a, nil
+}
+
+// Authenticate returns the user that made the given request.
+func (a *Authenticator) Authenticate(r *http.Request) (*User, error) {
+	if token := r.Header.Get("X-Auth-Token"); token != "" {
+		if a.keystone == nil {
+			return nil, errors.New("Keystone authentication is not enabled")
+		}
+		return a.keystone.validate(token)
+	}
+	if a.oidc != nil {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err == nil {
+			return a.sessions.decode(cookie.Value)
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+// Require wraps the given handler such that only users with the given access
+// can use it. Unauthenticated browsers are redirected to the OIDC login.
+func (a *Authenticator) Require(access Access, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.Authenticate(r)
+		if err != nil {
+			if err != errUnauthenticated {
+				logg.Info("authentication failed for %s %s: %s", r.Method, r.URL.Path, err.Error())
+			}
+			if a.oidc != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !user.Can(access, a.Config.Access) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+	})
+}
+
+// RegisterHandlers adds the endpoints for the OIDC login flow to the given
+// ServeMux, if OIDC is enabled.
+func (a *Authenticator) RegisterHandlers(mux *http.ServeMux) {
+	if a.oidc == nil {
+		return
+	}
+	mux.HandleFunc(loginPath, a.handleLogin)
+	mux.HandleFunc(callbackPath, a.handleCallback)
+	mux.HandleFunc(logoutPath, a.handleLogout)
+}
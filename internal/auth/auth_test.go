@@ -0,0 +1,355 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/sapcc/go-bits/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testClientID    = "dashboard"
+	testRedirectURL = "http://dashboard.example.com/auth/callback"
+)
+
+// newTestOIDCProvider starts a stand-in OIDC provider that issues an ID token
+// with the given claims for the authorization code "good-code".
+func newTestOIDCProvider(t *testing.T, claims map[string]interface{}) *httptest.Server {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test-key"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/authorize",
+			"token_endpoint":                        srv.URL + "/token",
+			"jwks_uri":                              srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test-key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		payload := map[string]interface{}{
+			"iss": srv.URL,
+			"aud": testClientID,
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			payload[k] = v
+		}
+		buf, _ := json.Marshal(payload)
+		sig, err := signer.Sign(buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		idToken, _ := sig.CompactSerialize()
+		writeJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	return srv
+}
+
+// newTestKeystone starts a stand-in Keystone that accepts the tokens
+// "valid-token" (scoped to project p1), "other-project-token" (scoped to
+// project p2) and "domain-token" (scoped to a domain), and counts the
+// validation requests.
+func newTestKeystone(t *testing.T, requests *int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/auth/tokens" || r.Header.Get("X-Auth-Token") != "service-token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		*requests++
+		token := map[string]interface{}{
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"user":       map[string]interface{}{"id": "u1", "name": "jdoe", "domain": map[string]string{"name": "ccadmin"}},
+			"roles":      []map[string]string{{"id": "r1", "name": "member"}, {"id": "r2", "name": "cloud_image_admin"}},
+		}
+		switch r.Header.Get("X-Subject-Token") {
+		case "valid-token":
+			token["project"] = map[string]interface{}{"id": "p1", "name": "cloud_admin"}
+		case "other-project-token":
+			token["project"] = map[string]interface{}{"id": "p2", "name": "team_a"}
+		case "domain-token":
+			token["domain"] = map[string]interface{}{"id": "d1", "name": "ccadmin"}
+		default:
+			http.Error(w, "token not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"token": token})
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+var testAccess = map[Access][]string{
+	AccessView: {AnyRole},
+	AccessScan: {"cloud_image_admin", "image-admins"},
+}
+
+// whoami is a handler that reports the authenticated user.
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, UserFromContext(r.Context()).Name)
+})
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestOIDCProvider(t, map[string]interface{}{
+		"sub":    "jane",
+		"groups": []string{"image-admins", "developers"},
+	})
+	defer idp.Close()
+
+	a, err := NewAuthenticator(context.Background(), Config{
+		OIDC:   &OIDCConfig{IssuerURL: idp.URL, ClientID: testClientID, RedirectURL: testRedirectURL},
+		Access: testAccess,
+	}, nil, []byte("session-key"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mux := http.NewServeMux()
+	a.RegisterHandlers(mux)
+	mux.Handle("/", a.Require(AccessView, whoami))
+	mux.Handle("/scan", a.Require(AccessScan, whoami))
+	mux.Handle("/debug", a.Require(AccessDebug, whoami))
+
+	do := func(path string, cookies []*http.Cookie, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//unauthenticated API clients get a 401, browsers are sent to the login
+	assert.DeepEqual(t, "API client", do("/", nil, nil).Code, http.StatusUnauthorized)
+	rec := do("/images?sort=oldest", nil, http.Header{"Accept": {"text/html"}})
+	assert.DeepEqual(t, "browser", rec.Code, http.StatusFound)
+	assert.DeepEqual(t, "browser redirect", rec.Header().Get("Location"), "/auth/login?next=%2Fimages%3Fsort%3Doldest")
+
+	//the login redirects to the identity provider
+	rec = do("/auth/login?next=%2Fimages%3Fsort%3Doldest", nil, nil)
+	assert.DeepEqual(t, "login", rec.Code, http.StatusFound)
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "authorization endpoint", target.Scheme+"://"+target.Host+target.Path, idp.URL+"/authorize")
+	assert.DeepEqual(t, "client ID", target.Query().Get("client_id"), testClientID)
+	state := target.Query().Get("state")
+	loginCookies := rec.Result().Cookies()
+
+	//the signed login state cannot be used as a session
+	for _, c := range loginCookies {
+		replayed := &http.Cookie{Name: sessionCookieName, Value: c.Value}
+		assert.DeepEqual(t, "login state as session", do("/", []*http.Cookie{replayed}, nil).Code, http.StatusUnauthorized)
+	}
+
+	//the callback must belong to the login that we started
+	rec = do("/auth/callback?code=good-code&state=wrong", loginCookies, nil)
+	assert.DeepEqual(t, "callback with wrong state", rec.Code, http.StatusBadRequest)
+	rec = do("/auth/callback?code=good-code&state="+state, nil, nil)
+	assert.DeepEqual(t, "callback without cookie", rec.Code, http.StatusBadRequest)
+	rec = do("/auth/callback?code=bad-code&state="+state, loginCookies, nil)
+	assert.DeepEqual(t, "callback with bad code", rec.Code, http.StatusUnauthorized)
+
+	rec = do("/auth/callback?code=good-code&state="+state, loginCookies, nil)
+	assert.DeepEqual(t, "callback", rec.Code, http.StatusFound)
+	assert.DeepEqual(t, "callback redirect", rec.Header().Get("Location"), "/images?sort=oldest")
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie set")
+	}
+
+	//with the session, access is granted according to the user's roles
+	rec = do("/", []*http.Cookie{session}, nil)
+	assert.DeepEqual(t, "view", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "user name", rec.Body.String(), "jane")
+	assert.DeepEqual(t, "scan", do("/scan", []*http.Cookie{session}, nil).Code, http.StatusOK)
+	assert.DeepEqual(t, "debug", do("/debug", []*http.Cookie{session}, nil).Code, http.StatusForbidden)
+
+	//tampered sessions are rejected
+	forged := &http.Cookie{Name: sessionCookieName, Value: "x" + session.Value}
+	assert.DeepEqual(t, "forged session", do("/", []*http.Cookie{forged}, nil).Code, http.StatusUnauthorized)
+}
+
+func TestKeystoneToken(t *testing.T) {
+	requests := 0
+	keystone := newTestKeystone(t, &requests)
+	defer keystone.Close()
+	identity := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "service-token"},
+		Endpoint:       keystone.URL + "/v3/",
+	}
+
+	testCases := []struct {
+		ProjectID string
+		Token     string
+		Path      string
+		Expected  int
+	}{
+		{"p1", "valid-token", "/", http.StatusOK},
+		{"p1", "valid-token", "/scan", http.StatusOK},
+		{"p1", "valid-token", "/debug", http.StatusForbidden},
+		{"p1", "invalid-token", "/", http.StatusUnauthorized},
+		{"p1", "", "/", http.StatusUnauthorized},
+		//roles from other projects or from domain-scoped tokens do not count
+		{"p1", "other-project-token", "/", http.StatusUnauthorized},
+		{"p1", "domain-token", "/", http.StatusUnauthorized},
+		{"p2", "valid-token", "/", http.StatusUnauthorized},
+		{"p2", "other-project-token", "/scan", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		a, err := NewAuthenticator(context.Background(), Config{
+			Keystone: &KeystoneConfig{ProjectID: tc.ProjectID},
+			Access:   testAccess,
+		}, identity, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", a.Require(AccessView, whoami))
+		mux.Handle("/scan", a.Require(AccessScan, whoami))
+		mux.Handle("/debug", a.Require(AccessDebug, whoami))
+
+		req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+		if tc.Token != "" {
+			req.Header.Set("X-Auth-Token", tc.Token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		desc := fmt.Sprintf("%s with token %q in project %q", tc.Path, tc.Token, tc.ProjectID)
+		assert.DeepEqual(t, desc, rec.Code, tc.Expected)
+		if rec.Code == http.StatusOK {
+			assert.DeepEqual(t, desc+": user", rec.Body.String(), "jdoe")
+		}
+	}
+
+	//validated tokens are cached
+	a, err := NewAuthenticator(context.Background(), Config{Keystone: &KeystoneConfig{ProjectID: "p1"}, Access: testAccess}, identity, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	requests = 0
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Auth-Token", "valid-token")
+		_, err := a.Authenticate(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assert.DeepEqual(t, "Keystone requests", requests, 1)
+}
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		Config Config
+		Error  string
+	}{
+		{Config{}, ""},
+		{Config{Keystone: &KeystoneConfig{ProjectID: "p1"}, Access: testAccess}, ""},
+		{Config{Keystone: &KeystoneConfig{}}, "keystone: project_id is missing"},
+		{Config{OIDC: &OIDCConfig{ClientID: testClientID, RedirectURL: testRedirectURL}}, "oidc: issuer_url is missing"},
+		{Config{Access: map[Access][]string{"admin": {AnyRole}}}, `unknown access level "admin" (expected "view", "scan" or "debug")`},
+		{Config{NamespaceRBAC: true}, "namespace_rbac requires oidc or keystone to be configured"},
+	}
+	for idx, tc := range testCases {
+		errMsg := ""
+		if err := tc.Config.Validate(); err != nil {
+			errMsg = err.Error()
+		}
+		assert.DeepEqual(t, fmt.Sprintf("error for config %d", idx), errMsg, tc.Error)
+	}
+}
+
+func TestSessionCodec(t *testing.T) {
+	sc, err := newSessionCodec([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expiresAt := time.Now().Add(time.Hour)
+
+	value, err := sc.encode(User{Name: "jane", Roles: []string{"viewer"}}, expiresAt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	user, err := sc.decode(value)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "user", *user, User{Name: "jane", Roles: []string{"viewer"}, Method: "oidc"})
+
+	//sessions without a user name are never valid
+	value, err = sc.encode(User{}, expiresAt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = sc.decode(value)
+	assert.DeepEqual(t, "error for empty name", err, errUnauthenticated)
+
+	//values signed for another cookie are rejected
+	value = sc.sign(stateCookieName, []byte(`{"name":"jane","exp":`+fmt.Sprint(expiresAt.Unix())+`}`))
+	_, err = sc.decode(value)
+	assert.DeepEqual(t, "error for other cookie", err.Error(), "invalid cookie signature")
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+)
+
+// keystoneCacheTTL is how long a validated Keystone token is remembered.
+const keystoneCacheTTL = 5 * time.Minute
+
+// KeystoneConfig contains the configuration for authentication with Keystone
+// tokens. The credentials for validating tokens are taken from the usual
+// OS_* environment variables, like for Swift.
+type KeystoneConfig struct {
+	// Only tokens that are scoped to this project are accepted. Otherwise, role
+	// names of different projects could not be told apart.
+	ProjectID string `json:"project_id"`
+}
+
+func (c KeystoneConfig) validate() error {
+	if c.ProjectID == "" {
+		return errors.New("project_id is missing")
+	}
+	return nil
+}
+
+type keystoneValidator struct {
+	config   KeystoneConfig
+	identity *gophercloud.ServiceClient
+	mutex    sync.Mutex
+	// maps the SHA-256 of a token to the validation result
+	cache map[[sha256.Size]byte]keystoneCacheEntry
+}
+
+type keystoneCacheEntry struct {
+	user      User
+	expiresAt time.Time
+}
+
+func newKeystoneValidator(cfg KeystoneConfig, identity *gophercloud.ServiceClient) *keystoneValidator {
+	return &keystoneValidator{
+		config:   cfg,
+		identity: identity,
+		cache:    make(map[[sha256.Size]byte]keystoneCacheEntry),
+	}
+}
+
+func (kv *keystoneValidator) validate(token string) (*User, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	kv.mutex.Lock()
+	entry, exists := kv.cache[key]
+	kv.mutex.Unlock()
+	if exists && now.Before(entry.expiresAt) {
+		user := entry.user
+		return &user, nil
+	}
+
+	result := tokens.Get(kv.identity, token)
+	t, err := result.ExtractToken()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Keystone token: %s", err.Error())
+	}
+	u, err := result.ExtractUser()
+	if err != nil {
+		return nil, err
+	}
+	project, err := result.ExtractProject()
+	if err != nil {
+		return nil, err
+	}
+	if project == nil || project.ID != kv.config.ProjectID {
+		return nil, fmt.Errorf("Keystone token for user %s is not scoped to project %s", u.Name, kv.config.ProjectID)
+	}
+	roles, err := result.ExtractRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	user := User{Name: u.Name, Method: "keystone"}
+	for _, role := range roles {
+		user.Roles = append(user.Roles, role.Name)
+	}
+	expiresAt := now.Add(keystoneCacheTTL)
+	if t.ExpiresAt.Before(expiresAt) {
+		expiresAt = t.ExpiresAt
+	}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for k, e := range kv.cache {
+		if now.After(e.expiresAt) {
+			delete(kv.cache, k)
+		}
+	}
+	kv.cache[key] = keystoneCacheEntry{user: user, expiresAt: expiresAt}
+	return &user, nil
+}
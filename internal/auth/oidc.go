@@ -0,0 +1,245 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/oauth2"
+)
+
+// Paths of the endpoints for the OIDC login flow.
+const (
+	loginPath    = "/auth/login"
+	callbackPath = "/auth/callback"
+	logoutPath   = "/auth/logout"
+)
+
+// Lifetime of a session after an OIDC login, and of a login in progress.
+const (
+	sessionTTL = 8 * time.Hour
+	loginTTL   = 10 * time.Minute
+)
+
+// OIDCConfig contains the configuration for the OIDC login flow.
+type OIDCConfig struct {
+	IssuerURL string `json:"issuer_url"`
+	ClientID  string `json:"client_id"`
+	// The client secret is not read from the configuration file, so that it
+	// does not show up on the debug endpoint.
+	ClientSecret string `json:"-"`
+	// The key for signing sessions, which is not read from the configuration
+	// file for the same reason. If empty, a random key is used.
+	SessionKey string `json:"-"`
+	// Must point to the path "/auth/callback" of the dashboard.
+	RedirectURL string `json:"redirect_url"`
+	// Additional scopes to request, e.g. "groups".
+	Scopes []string `json:"scopes,omitempty"`
+	// The ID token claims that contain the user name and roles. Defaults are
+	// "sub" and "groups".
+	UsernameClaim string `json:"username_claim,omitempty"`
+	RolesClaim    string `json:"roles_claim,omitempty"`
+}
+
+func (c OIDCConfig) validate() error {
+	switch {
+	case c.IssuerURL == "":
+		return errors.New("issuer_url is missing")
+	case c.ClientID == "":
+		return errors.New("client_id is missing")
+	case !strings.HasSuffix(c.RedirectURL, callbackPath):
+		return fmt.Errorf("redirect_url must end with %q", callbackPath)
+	default:
+		return nil
+	}
+}
+
+type oidcProvider struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCProvider(ctx context.Context, cfg OIDCConfig) (*oidcProvider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC provider %s: %s", cfg.IssuerURL, err.Error())
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "groups"
+	}
+	return &oidcProvider{
+		config: cfg,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// userFromToken verifies the ID token in the given token response, and
+// extracts the user from its claims.
+func (p *oidcProvider) userFromToken(ctx context.Context, token *oauth2.Token) (User, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return User{}, errors.New("no ID token received")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return User{}, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return User{}, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+
+	name, _ := claims[p.config.UsernameClaim].(string)
+	if name == "" {
+		return User{}, fmt.Errorf("ID token has no %q claim", p.config.UsernameClaim)
+	}
+	user := User{Name: name, Method: "oidc"}
+	switch roles := claims[p.config.RolesClaim].(type) {
+	case string:
+		user.Roles = []string{roles}
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				user.Roles = append(user.Roles, s)
+			}
+		}
+	}
+	return user, nil
+}
+
+// loginState is the payload of the cookie that is set while a login is in
+// progress.
+type loginState struct {
+	State     string `json:"state"`
+	Next      string `json:"next"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// isLocalPath checks whether the given redirect target stays on this site.
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+func (a *Authenticator) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.oidc.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Authenticator) deleteCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+}
+
+func (a *Authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state := loginState{
+		State:     base64.RawURLEncoding.EncodeToString(buf),
+		Next:      next,
+		ExpiresAt: time.Now().Add(loginTTL).Unix(),
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setCookie(w, stateCookieName, a.sessions.sign(stateCookieName, payload), loginTTL)
+	http.Redirect(w, r, a.oidc.oauth2.AuthCodeURL(state.State), http.StatusFound)
+}
+
+func (a *Authenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		http.Error(w, "login failed: "+msg+" "+query.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	//check that this callback belongs to a login that we started
+	var state loginState
+	cookie, err := r.Cookie(stateCookieName)
+	if err == nil {
+		var payload []byte
+		payload, err = a.sessions.verify(stateCookieName, cookie.Value)
+		if err == nil {
+			err = json.Unmarshal(payload, &state)
+		}
+	}
+	if err != nil || state.State == "" || state.State != query.Get("state") || time.Now().Unix() > state.ExpiresAt {
+		http.Error(w, "login failed: invalid or expired login state, please try again", http.StatusBadRequest)
+		return
+	}
+	a.deleteCookie(w, stateCookieName)
+
+	token, err := a.oidc.oauth2.Exchange(r.Context(), query.Get("code"))
+	if err != nil {
+		logg.Error("OIDC code exchange failed: %s", err.Error())
+		http.Error(w, "login failed: could not redeem authorization code", http.StatusUnauthorized)
+		return
+	}
+	user, err := a.oidc.userFromToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "login failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	value, err := a.sessions.encode(user, time.Now().Add(sessionTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logg.Info("user %s logged in via OIDC", user.Name)
+	a.setCookie(w, sessionCookieName, value, sessionTTL)
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	a.deleteCookie(w, sessionCookieName)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespaceDecisionTTL is how long the outcome of a SubjectAccessReview is
+// cached.
+const namespaceDecisionTTL = 5 * time.Minute
+
+// maxNamespaceDecisions is the cache size above which expired decisions are
+// pruned.
+const maxNamespaceDecisions = 10000
+
+// maxConcurrentReviews is how many SubjectAccessReviews are sent at the same
+// time when checking the namespaces for a page.
+const maxConcurrentReviews = 10
+
+// NamespaceAuthorizer decides which namespaces a user may see, by asking the
+// Kubernetes API whether the user may list pods in the namespace. The user's
+// roles are passed to Kubernetes as groups.
+type NamespaceAuthorizer struct {
+	clientset kubernetes.Interface
+	// for tests
+	now func() time.Time
+
+	mutex     sync.Mutex
+	decisions map[namespaceDecisionKey]namespaceDecision
+}
+
+type namespaceDecisionKey struct {
+	User      string
+	Groups    string
+	Namespace string
+}
+
+type namespaceDecision struct {
+	Allowed   bool
+	ExpiresAt time.Time
+}
+
+// NewNamespaceAuthorizer initializes a NamespaceAuthorizer.
+func NewNamespaceAuthorizer(clientset kubernetes.Interface) *NamespaceAuthorizer {
+	return &NamespaceAuthorizer{
+		clientset: clientset,
+		now:       time.Now,
+		decisions: make(map[namespaceDecisionKey]namespaceDecision),
+	}
+}
+
+// CanListPods checks whether the given user may list pods in the given
+// namespace. If the decision cannot be obtained, access is denied.
+func (a *NamespaceAuthorizer) CanListPods(ctx context.Context, user User, namespace string) bool {
+	key := namespaceDecisionKey{user.Name, strings.Join(user.Roles, "\x00"), namespace}
+	now := a.now()
+	a.mutex.Lock()
+	decision, exists := a.decisions[key]
+	a.mutex.Unlock()
+	if exists && now.Before(decision.ExpiresAt) {
+		return decision.Allowed
+	}
+
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Name,
+			Groups: user.Roles,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "list",
+				Resource:  "pods",
+			},
+		},
+	}
+	result, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		//do not cache errors, the next request shall try again
+		logg.Error("could not check access of user %s to namespace %s: %s", user.Name, namespace, err.Error())
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.decisions) >= maxNamespaceDecisions {
+		for k, d := range a.decisions {
+			if !now.Before(d.ExpiresAt) {
+				delete(a.decisions, k)
+			}
+		}
+	}
+	a.decisions[key] = namespaceDecision{result.Status.Allowed, now.Add(namespaceDecisionTTL)}
+	return result.Status.Allowed
+}
+
+// VisibleNamespaces checks which of the given namespaces the given user may
+// see, sending up to maxConcurrentReviews SubjectAccessReviews at the same
+// time. It returns a function that reports these decisions, so it can be
+// called for every item on a page. Namespaces that were not given upfront are
+// checked when they are first asked for.
+func (a *NamespaceAuthorizer) VisibleNamespaces(ctx context.Context, user User, namespaces []string) func(namespace string) bool {
+	visible := make(map[string]bool, len(namespaces))
+	var unique []string
+	for _, namespace := range namespaces {
+		if _, exists := visible[namespace]; !exists {
+			visible[namespace] = false
+			unique = append(unique, namespace)
+		}
+	}
+
+	var (
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, maxConcurrentReviews)
+	)
+	for _, namespace := range unique {
+		wg.Add(1)
+		go func(namespace string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			allowed := a.CanListPods(ctx, user, namespace)
+			<-semaphore
+			mutex.Lock()
+			visible[namespace] = allowed
+			mutex.Unlock()
+		}(namespace)
+	}
+	wg.Wait()
+
+	return func(namespace string) bool {
+		allowed, exists := visible[namespace]
+		if !exists {
+			allowed = a.CanListPods(ctx, user, namespace)
+			visible[namespace] = allowed
+		}
+		return allowed
+	}
+}
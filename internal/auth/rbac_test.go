@@ -0,0 +1,114 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNamespaceAuthorizer(t *testing.T) {
+	//members of "team-a" may list pods in "team-a", admins everywhere
+	clientset := fake.NewSimpleClientset()
+	reviews := 0
+	failing := false
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		if failing {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		if attrs.Verb != "list" || attrs.Resource != "pods" {
+			t.Errorf("unexpected resource attributes: %#v", attrs)
+		}
+		for _, group := range review.Spec.Groups {
+			if group == "admins" || group == attrs.Namespace {
+				review.Status.Allowed = true
+			}
+		}
+		return true, review, nil
+	})
+
+	a := NewNamespaceAuthorizer(clientset)
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+	ctx := context.Background()
+	alice := User{Name: "alice", Roles: []string{"team-a"}}
+	bob := User{Name: "bob", Roles: []string{"admins"}}
+
+	assert.DeepEqual(t, "alice in team-a", a.CanListPods(ctx, alice, "team-a"), true)
+	assert.DeepEqual(t, "alice in team-b", a.CanListPods(ctx, alice, "team-b"), false)
+	assert.DeepEqual(t, "bob in team-b", a.CanListPods(ctx, bob, "team-b"), true)
+	assert.DeepEqual(t, "reviews", reviews, 3)
+
+	//decisions are cached until they expire
+	visible := a.VisibleNamespaces(ctx, alice, []string{"team-a", "team-b"})
+	for i := 0; i < 3; i++ {
+		assert.DeepEqual(t, "alice in team-a (cached)", visible("team-a"), true)
+		assert.DeepEqual(t, "alice in team-b (cached)", visible("team-b"), false)
+	}
+	assert.DeepEqual(t, "reviews after cache hits", reviews, 3)
+	now = now.Add(namespaceDecisionTTL)
+	assert.DeepEqual(t, "alice in team-a (expired)", a.CanListPods(ctx, alice, "team-a"), true)
+	assert.DeepEqual(t, "reviews after expiry", reviews, 4)
+
+	//a user with different roles gets a separate decision
+	alice.Roles = append(alice.Roles, "admins")
+	assert.DeepEqual(t, "alice with admins role", a.CanListPods(ctx, alice, "team-b"), true)
+
+	//errors deny access and are not cached
+	failing = true
+	assert.DeepEqual(t, "failing review", a.CanListPods(ctx, bob, "team-c"), false)
+	failing = false
+	assert.DeepEqual(t, "review after failure", a.CanListPods(ctx, bob, "team-c"), true)
+}
+
+func TestVisibleNamespaces(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	reviewed := make(map[string]int)
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewed[review.Spec.ResourceAttributes.Namespace]++
+		review.Status.Allowed = review.Spec.ResourceAttributes.Namespace < "ns-20"
+		return true, review, nil
+	})
+
+	//more namespaces than maxConcurrentReviews, with duplicates
+	var namespaces []string
+	for i := 0; i < 3*maxConcurrentReviews; i++ {
+		namespaces = append(namespaces, fmt.Sprintf("ns-%02d", i), fmt.Sprintf("ns-%02d", i))
+	}
+	a := NewNamespaceAuthorizer(clientset)
+	visible := a.VisibleNamespaces(context.Background(), User{Name: "alice"}, namespaces)
+	assert.DeepEqual(t, "reviewed namespaces", len(reviewed), 3*maxConcurrentReviews)
+	for _, namespace := range namespaces {
+		assert.DeepEqual(t, "reviews for "+namespace, reviewed[namespace], 1)
+		assert.DeepEqual(t, "visibility of "+namespace, visible(namespace), namespace < "ns-20")
+	}
+
+	//namespaces that were not given upfront are checked on demand
+	assert.DeepEqual(t, "visibility of ns-99", visible("ns-99"), false)
+	assert.DeepEqual(t, "reviews for ns-99", reviewed["ns-99"], 1)
+}
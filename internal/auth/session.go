@@ -0,0 +1,118 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Names of the cookies that hold the session of a user that logged in via
+// OIDC, and the state of a login that is in progress.
+const (
+	sessionCookieName = "image_migration_dashboard_session"
+	stateCookieName   = "image_migration_dashboard_login"
+)
+
+// sessionCodec signs and verifies the contents of cookies, so that the server
+// does not need to store sessions. Each signature covers the name of the
+// cookie, so that a value that was issued for one cookie (e.g. the login
+// state) cannot be used as another one (e.g. the session).
+type sessionCodec struct {
+	key []byte
+}
+
+func newSessionCodec(key []byte) (*sessionCodec, error) {
+	if len(key) == 0 {
+		//sessions are lost when the server restarts, which is fine for a
+		//dashboard
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &sessionCodec{key: key}, nil
+}
+
+// session is the payload of the session cookie.
+type session struct {
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+func (sc *sessionCodec) mac(cookieName string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, sc.key)
+	mac.Write([]byte(cookieName))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (sc *sessionCodec) sign(cookieName string, payload []byte) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sc.mac(cookieName, payload))
+}
+
+func (sc *sessionCodec) verify(cookieName, value string) ([]byte, error) {
+	fields := strings.SplitN(value, ".", 2)
+	if len(fields) != 2 {
+		return nil, errors.New("malformed cookie")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(fields[0])
+	if err != nil {
+		return nil, errors.New("malformed cookie")
+	}
+	signature, err := enc.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.New("malformed cookie")
+	}
+	if !hmac.Equal(signature, sc.mac(cookieName, payload)) {
+		return nil, errors.New("invalid cookie signature")
+	}
+	return payload, nil
+}
+
+func (sc *sessionCodec) encode(user User, expiresAt time.Time) (string, error) {
+	payload, err := json.Marshal(session{Name: user.Name, Roles: user.Roles, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	return sc.sign(sessionCookieName, payload), nil
+}
+
+func (sc *sessionCodec) decode(value string) (*User, error) {
+	payload, err := sc.verify(sessionCookieName, value)
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	err = json.Unmarshal(payload, &s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Name == "" || time.Now().Unix() > s.ExpiresAt {
+		return nil, errUnauthenticated
+	}
+	return &User{Name: s.Name, Roles: s.Roles, Method: "oidc"}, nil
+}
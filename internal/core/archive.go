@@ -0,0 +1,398 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// The format version of archives written by ExportArchive. Archives with a
+// newer version are rejected by ImportArchive.
+const archiveFormatVersion = 1
+
+// Names of the entries in an archive. The manifest comes first, followed by
+// the image report and the scans in chronological order. The raw data of a
+// scan (if any) directly follows its result.
+const (
+	archiveManifestEntry = "manifest.json"
+	archiveImagesEntry   = "images.json"
+	archiveResultEntry   = "result.json"
+	archiveRawEntry      = "raw.json"
+	archiveScansDir      = "scans"
+)
+
+// ArchiveManifest describes the content of an archive.
+type ArchiveManifest struct {
+	FormatVersion int   `json:"format_version"`
+	CreatedAt     int64 `json:"created_at"` // UTC
+	// The scrape time of the latest scan, which the image report belongs to.
+	// Zero if the archive does not contain any scans.
+	LastScrapedAt int64 `json:"last_scraped_at"`
+	NoOfScans     int   `json:"no_of_scans"`
+}
+
+// archivedImages is the content of the image report entry.
+type archivedImages struct {
+	ScrapedAt int64       `json:"scraped_at"`
+	Images    ImageReport `json:"images"`
+}
+
+// ArchiveStats contains the number of scans that were exported or imported.
+type ArchiveStats struct {
+	Scans    int
+	RawScans int // scans with raw data
+	// Only for imports: scans that were not imported in merge mode, since the
+	// storage already has a newer scan for the same date.
+	Skipped int
+}
+
+// ImportMode determines how ImportArchive treats existing data.
+type ImportMode string
+
+const (
+	// ImportMerge keeps existing scans, unless the archive contains a newer
+	// scan for the same date.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace overwrites existing scans with those from the archive, and
+	// then deletes all existing scans on other dates.
+	ImportReplace ImportMode = "replace"
+)
+
+// ExportArchive writes all data from the given storage into a tar archive.
+func ExportArchive(w io.Writer, storage Storage, now time.Time) (ArchiveStats, error) {
+	db := Database{DailyResults: make(map[string]ScanResult)}
+	err := storage.Load(&db)
+	if err != nil {
+		return ArchiveStats{}, fmt.Errorf("could not load history: %s", err.Error())
+	}
+	var dates []string
+	for date := range db.DailyResults {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	manifest := ArchiveManifest{
+		FormatVersion: archiveFormatVersion,
+		CreatedAt:     now.Unix(),
+		NoOfScans:     len(dates),
+	}
+	if len(dates) > 0 {
+		manifest.LastScrapedAt = db.DailyResults[dates[len(dates)-1]].ScrapedAt
+	}
+	tw := tar.NewWriter(w)
+	err = writeArchiveEntry(tw, archiveManifestEntry, manifest.CreatedAt, manifest)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	if len(dates) > 0 {
+		err = writeArchiveEntry(tw, archiveImagesEntry, manifest.LastScrapedAt, archivedImages{manifest.LastScrapedAt, db.Images})
+		if err != nil {
+			return ArchiveStats{}, err
+		}
+	}
+
+	var stats ArchiveStats
+	writeResultsUntil := func(date string) error {
+		for stats.Scans < len(dates) && dates[stats.Scans] <= date {
+			result := db.DailyResults[dates[stats.Scans]]
+			err := writeArchiveEntry(tw, path.Join(archiveScansDir, dates[stats.Scans], archiveResultEntry), result.ScrapedAt, result)
+			if err != nil {
+				return err
+			}
+			stats.Scans++
+		}
+		return nil
+	}
+	//raw scans are iterated oldest first, so the results can be interleaved
+	//without keeping all raw scans in memory
+	err = storage.ForeachRawScan(func(raw RawScan) error {
+		date := time.Unix(raw.ScrapedAt, 0).UTC().Format(ISODateFormat)
+		if _, exists := db.DailyResults[date]; !exists {
+			logg.Info("skipping raw data from %s since there is no scan result for this date", date)
+			return nil
+		}
+		err := writeResultsUntil(date)
+		if err != nil {
+			return err
+		}
+		stats.RawScans++
+		return writeArchiveEntry(tw, path.Join(archiveScansDir, date, archiveRawEntry), raw.ScrapedAt, raw)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if len(dates) > 0 {
+		err = writeResultsUntil(dates[len(dates)-1])
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, tw.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, modTime int64, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not serialize %s: %s", name, err.Error())
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(buf)),
+		ModTime:  time.Unix(modTime, 0),
+	})
+	if err == nil {
+		_, err = tw.Write(buf)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// archiveEntry is a decoded entry of an archive. Exactly one of the pointers
+// is set.
+type archiveEntry struct {
+	Name     string
+	Date     string // only for scans
+	Manifest *ArchiveManifest
+	Images   *archivedImages
+	Result   *ScanResult
+	Raw      *RawScan
+}
+
+// readArchive calls the given function for each entry of an archive.
+func readArchive(r io.Reader, fn func(archiveEntry) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read archive: %s", err.Error())
+		}
+
+		entry := archiveEntry{Name: hdr.Name}
+		var target interface{}
+		fields := strings.Split(hdr.Name, "/")
+		switch {
+		case hdr.Name == archiveManifestEntry:
+			entry.Manifest = &ArchiveManifest{}
+			target = entry.Manifest
+		case hdr.Name == archiveImagesEntry:
+			entry.Images = &archivedImages{}
+			target = entry.Images
+		case len(fields) == 3 && fields[0] == archiveScansDir && fields[2] == archiveResultEntry:
+			entry.Result = &ScanResult{}
+			target = entry.Result
+		case len(fields) == 3 && fields[0] == archiveScansDir && fields[2] == archiveRawEntry:
+			entry.Raw = &RawScan{}
+			target = entry.Raw
+		default:
+			return fmt.Errorf("unexpected entry %s in archive", hdr.Name)
+		}
+		if entry.Result != nil || entry.Raw != nil {
+			entry.Date = fields[1]
+			if _, err := time.Parse(ISODateFormat, entry.Date); err != nil {
+				return fmt.Errorf("unexpected entry %s in archive", hdr.Name)
+			}
+		}
+		err = json.NewDecoder(tr).Decode(target)
+		if err != nil {
+			return fmt.Errorf("could not parse %s: %s", hdr.Name, err.Error())
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkArchive validates the structure and the timestamps of an archive, and
+// returns its manifest and image report.
+func checkArchive(r io.Reader) (ArchiveManifest, archivedImages, error) {
+	var (
+		manifest   *ArchiveManifest
+		images     *archivedImages
+		lastResult ScanResult
+		lastDate   string
+		hasRaw     bool
+		noOfScans  int
+	)
+	err := readArchive(r, func(entry archiveEntry) error {
+		if manifest == nil && entry.Manifest == nil {
+			return fmt.Errorf("archive does not start with %s", archiveManifestEntry)
+		}
+		var scrapedAt int64
+		switch {
+		case entry.Manifest != nil:
+			if manifest != nil {
+				return fmt.Errorf("duplicate entry %s in archive", entry.Name)
+			}
+			manifest = entry.Manifest
+			if manifest.FormatVersion < 1 || manifest.FormatVersion > archiveFormatVersion {
+				return fmt.Errorf("archive has unsupported format version %d", manifest.FormatVersion)
+			}
+			return nil
+		case entry.Images != nil:
+			if images != nil {
+				return fmt.Errorf("duplicate entry %s in archive", entry.Name)
+			}
+			images = entry.Images
+			return nil
+		case entry.Result != nil:
+			if entry.Date <= lastDate {
+				return fmt.Errorf("%s is not in chronological order", entry.Name)
+			}
+			lastResult, lastDate, hasRaw = *entry.Result, entry.Date, false
+			noOfScans++
+			scrapedAt = entry.Result.ScrapedAt
+		case entry.Raw != nil:
+			if entry.Date != lastDate || hasRaw {
+				return fmt.Errorf("%s does not follow the scan result of the same date", entry.Name)
+			}
+			hasRaw = true
+			scrapedAt = entry.Raw.ScrapedAt
+		}
+		if date := time.Unix(scrapedAt, 0).UTC().Format(ISODateFormat); date != entry.Date {
+			return fmt.Errorf("%s was scraped on %s", entry.Name, date)
+		}
+		if scrapedAt > manifest.CreatedAt {
+			return fmt.Errorf("%s was scraped after the archive was created", entry.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return ArchiveManifest{}, archivedImages{}, err
+	}
+
+	switch {
+	case manifest == nil:
+		return ArchiveManifest{}, archivedImages{}, fmt.Errorf("archive does not contain %s", archiveManifestEntry)
+	case noOfScans != manifest.NoOfScans:
+		return ArchiveManifest{}, archivedImages{}, fmt.Errorf("archive contains %d scans, but the manifest lists %d", noOfScans, manifest.NoOfScans)
+	case lastResult.ScrapedAt != manifest.LastScrapedAt:
+		return ArchiveManifest{}, archivedImages{}, fmt.Errorf("latest scan was scraped at %d, but the manifest lists %d", lastResult.ScrapedAt, manifest.LastScrapedAt)
+	case noOfScans > 0 && images == nil:
+		return ArchiveManifest{}, archivedImages{}, fmt.Errorf("archive does not contain %s", archiveImagesEntry)
+	case images != nil && images.ScrapedAt != manifest.LastScrapedAt:
+		return ArchiveManifest{}, archivedImages{}, fmt.Errorf("image report was scraped at %d, but the latest scan at %d", images.ScrapedAt, manifest.LastScrapedAt)
+	}
+	if images == nil {
+		images = &archivedImages{}
+	}
+	return *manifest, *images, nil
+}
+
+// ImportArchive loads an archive written by ExportArchive into the given
+// storage. Since the archive is validated completely before any data is
+// written, it is read twice, so the given function must open it from the
+// start each time.
+func ImportArchive(ctx context.Context, storage Storage, open func() (io.ReadCloser, error), mode ImportMode) (ArchiveStats, error) {
+	reader, err := open()
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	manifest, images, err := checkArchive(reader)
+	reader.Close()
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+
+	//in replace mode, existing data is only deleted after the import
+	//succeeded, so that a failed import does not leave an empty storage behind
+	current := Database{DailyResults: make(map[string]ScanResult)}
+	switch mode {
+	case ImportMerge:
+		err = storage.Load(&current)
+		if err != nil {
+			return ArchiveStats{}, fmt.Errorf("could not load history: %s", err.Error())
+		}
+	case ImportReplace:
+	default:
+		return ArchiveStats{}, fmt.Errorf("unknown import mode %q", mode)
+	}
+
+	var stats ArchiveStats
+	imported := make(map[string]bool)
+	save := func(result ScanResult, raw *RawScan) error {
+		date := time.Unix(result.ScrapedAt, 0).UTC().Format(ISODateFormat)
+		imported[date] = true
+		if existing, exists := current.DailyResults[date]; exists && existing.ScrapedAt >= result.ScrapedAt {
+			stats.Skipped++
+			return nil
+		}
+		//only the latest scan has an image report, and it is only used if
+		//the storage does not have a newer scan
+		var imgReport *ImageReport
+		if result.ScrapedAt == manifest.LastScrapedAt && (current.LastScrapeTime.IsZero() || result.ScrapedAt > current.LastScrapeTime.Unix()) {
+			imgReport = &images.Images
+		}
+		stats.Scans++
+		if raw != nil {
+			stats.RawScans++
+		}
+		return storage.Save(ctx, result, imgReport, raw)
+	}
+
+	reader, err = open()
+	if err != nil {
+		return stats, err
+	}
+	defer reader.Close()
+	var pending *ScanResult
+	err = readArchive(reader, func(entry archiveEntry) error {
+		switch {
+		case entry.Result != nil:
+			if pending != nil {
+				err := save(*pending, nil)
+				if err != nil {
+					return err
+				}
+			}
+			pending = entry.Result
+		case entry.Raw != nil:
+			//checkArchive ensured that raw data follows its result
+			err := save(*pending, entry.Raw)
+			pending = nil
+			return err
+		}
+		return nil
+	})
+	if err == nil && pending != nil {
+		err = save(*pending, nil)
+	}
+	if err != nil || mode != ImportReplace {
+		return stats, err
+	}
+
+	err = storage.DeleteOtherScans(ctx, imported)
+	if err != nil {
+		return stats, fmt.Errorf("could not delete existing scans that are not in the archive: %s", err.Error())
+	}
+	return stats, nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func exportTestArchive(t *testing.T, storage Storage) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := ExportArchive(&buf, storage, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func importTestArchive(storage Storage, archive []byte, mode ImportMode) (ArchiveStats, error) {
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	}
+	return ImportArchive(context.Background(), storage, open, mode)
+}
+
+func TestArchiveExportAndReplace(t *testing.T) {
+	ctx := context.Background()
+	source := &MemoryStorage{}
+	for day := 1; day <= 3; day++ {
+		result, images := testScan(day)
+		var raw *RawScan
+		if day != 2 {
+			raw = &RawScan{ScrapedAt: result.ScrapedAt, Containers: []RawContainer{{Name: "monsoon3/app/app", Image: images.Quay[0].Name}}}
+		}
+		err := source.Save(ctx, result, &images, raw)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var buf bytes.Buffer
+	stats, err := ExportArchive(&buf, source, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "export stats", stats, ArchiveStats{Scans: 3, RawScans: 2})
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		names = append(names, hdr.Name)
+	}
+	assert.DeepEqual(t, "archive entries", names, []string{
+		"manifest.json",
+		"images.json",
+		"scans/2020-06-01/result.json",
+		"scans/2020-06-01/raw.json",
+		"scans/2020-06-02/result.json",
+		"scans/2020-06-03/result.json",
+		"scans/2020-06-03/raw.json",
+	})
+
+	//existing data is removed in replace mode, but only once the import
+	//succeeded
+	backend := newFakeSwift()
+	target := newTestSwiftStorage(t, backend)
+	result5, images5 := testScan(5)
+	err = target.Save(ctx, result5, &images5, &RawScan{ScrapedAt: result5.ScrapedAt})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	backend.broken["test/scan-result/2020-06-02"] = true
+	_, err = importTestArchive(target, buf.Bytes(), ImportReplace)
+	if err == nil {
+		t.Fatal("expected import to fail")
+	}
+	db := newTestDatabase(t)
+	err = target.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results after failed import", db.DailyResults, map[string]ScanResult{
+		"2020-06-01": source.DailyResults["2020-06-01"],
+		"2020-06-05": result5,
+	})
+	assert.DeepEqual(t, "images after failed import", db.Images, images5)
+
+	delete(backend.broken, "test/scan-result/2020-06-02")
+	stats, err = importTestArchive(target, buf.Bytes(), ImportReplace)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "import stats", stats, ArchiveStats{Scans: 3, RawScans: 2})
+	//only the latest scan in the archive comes with image data
+	assert.DeepEqual(t, "objects", backend.objectNames(), []string{
+		fmt.Sprintf("test/image_data/%d", source.DailyResults["2020-06-03"].ScrapedAt),
+		"test/raw-data/2020-06-01",
+		"test/raw-data/2020-06-03",
+		"test/scan-result/2020-06-01",
+		"test/scan-result/2020-06-02",
+		"test/scan-result/2020-06-03",
+	})
+
+	db = newTestDatabase(t)
+	err = target.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, source.DailyResults)
+	assert.DeepEqual(t, "images", db.Images, source.Images)
+	var rawScans []RawScan
+	err = target.ForeachRawScan(func(raw RawScan) error {
+		rawScans = append(rawScans, raw)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "raw scans", rawScans, []RawScan{source.RawScans["2020-06-01"], source.RawScans["2020-06-03"]})
+}
+
+func TestArchiveMerge(t *testing.T) {
+	ctx := context.Background()
+	source := &MemoryStorage{}
+	for day := 1; day <= 3; day++ {
+		result, images := testScan(day)
+		err := source.Save(ctx, result, &images, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	archive := exportTestArchive(t, source)
+
+	//the target has a newer scan for day 2, and a scan after the archive
+	target := &MemoryStorage{}
+	result2, images2 := testScan(2)
+	result2.ScrapedAt += 3600
+	result4, images4 := testScan(4)
+	for _, scan := range []struct {
+		Result ScanResult
+		Images ImageReport
+	}{{result2, images2}, {result4, images4}} {
+		err := target.Save(ctx, scan.Result, &scan.Images, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	stats, err := importTestArchive(target, archive, ImportMerge)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "import stats", stats, ArchiveStats{Scans: 2, Skipped: 1})
+	assert.DeepEqual(t, "daily results", target.DailyResults, map[string]ScanResult{
+		"2020-06-01": source.DailyResults["2020-06-01"],
+		"2020-06-02": result2,
+		"2020-06-03": source.DailyResults["2020-06-03"],
+		"2020-06-04": result4,
+	})
+	assert.DeepEqual(t, "images", target.Images, images4)
+}
+
+func TestArchiveReplaceMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	source := &MemoryStorage{}
+	for day := 1; day <= 2; day++ {
+		result, images := testScan(day)
+		err := source.Save(ctx, result, &images, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	archive := exportTestArchive(t, source)
+
+	//the image report of a newer scan that is not in the archive is replaced
+	//by the one from the archive
+	target := &MemoryStorage{}
+	result3, images3 := testScan(3)
+	err := target.Save(ctx, result3, &images3, &RawScan{ScrapedAt: result3.ScrapedAt})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = importTestArchive(target, archive, ImportReplace)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", target.DailyResults, source.DailyResults)
+	assert.DeepEqual(t, "images", target.Images, source.Images)
+	assert.DeepEqual(t, "raw scans", len(target.RawScans), 0)
+}
+
+func TestArchiveValidation(t *testing.T) {
+	day1 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC).Unix()
+	createdAt := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC).Unix()
+	type entry struct {
+		Name string
+		Data interface{}
+	}
+	buildArchive := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			err := writeArchiveEntry(tw, e.Name, createdAt, e.Data)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		err := tw.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return buf.Bytes()
+	}
+	manifest := ArchiveManifest{FormatVersion: 1, CreatedAt: createdAt, LastScrapedAt: day1, NoOfScans: 1}
+	images := entry{"images.json", archivedImages{ScrapedAt: day1}}
+	result := entry{"scans/2020-06-01/result.json", ScanResult{ScrapedAt: day1}}
+
+	testCases := []struct {
+		Archive []byte
+		Error   string
+	}{
+		{buildArchive(images, entry{"manifest.json", manifest}, result),
+			"archive does not start with manifest.json"},
+		{buildArchive(entry{"manifest.json", ArchiveManifest{FormatVersion: 99}}),
+			"archive has unsupported format version 99"},
+		{buildArchive(entry{"manifest.json", manifest}, images, entry{"scans/2020-06-02/result.json", ScanResult{ScrapedAt: day1}}),
+			"scans/2020-06-02/result.json was scraped on 2020-06-01"},
+		{buildArchive(entry{"manifest.json", manifest}, images, result, entry{"scans/2020-06-02/raw.json", RawScan{ScrapedAt: day1}}),
+			"scans/2020-06-02/raw.json does not follow the scan result of the same date"},
+		{buildArchive(entry{"manifest.json", ArchiveManifest{FormatVersion: 1, CreatedAt: day1 - 1, LastScrapedAt: day1, NoOfScans: 1}}, images, result),
+			"scans/2020-06-01/result.json was scraped after the archive was created"},
+		{buildArchive(entry{"manifest.json", ArchiveManifest{FormatVersion: 1, CreatedAt: createdAt, LastScrapedAt: day1, NoOfScans: 2}}, images, result),
+			"archive contains 1 scans, but the manifest lists 2"},
+		{buildArchive(entry{"manifest.json", manifest}, entry{"images.json", archivedImages{ScrapedAt: day1 - 1}}, result),
+			"image report was scraped at 1591012799, but the latest scan at 1591012800"},
+		{buildArchive(entry{"manifest.json", manifest}, images, result, entry{"notes.txt", "hello"}),
+			"unexpected entry notes.txt in archive"},
+	}
+	for _, tc := range testCases {
+		storage := &MemoryStorage{}
+		_, err := importTestArchive(storage, tc.Archive, ImportReplace)
+		if err == nil {
+			t.Errorf("expected error %q, but import succeeded", tc.Error)
+			continue
+		}
+		assert.DeepEqual(t, "error", err.Error(), tc.Error)
+		//nothing is written if the archive is invalid
+		assert.DeepEqual(t, "daily results", len(storage.DailyResults), 0)
+	}
+}
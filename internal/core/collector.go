@@ -15,15 +15,17 @@
 package core
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sapcc/go-bits/logg"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -34,115 +36,579 @@ var imageFormatRx = regexp.MustCompile(`^(\S+)\.\S+\.\S+\.\S+/.*$`)
 //instead of "example.com/foo/bar"), then it's coming from Docker Hub.
 var dockerHubRx = regexp.MustCompile(`^[^/.]+(?:[/:].*)?$`)
 
-// ScanCluster scans a cluster for all the pods, processes the information,
-// and saves it to the object store.
-func (db *Database) ScanCluster(clientset *kubernetes.Clientset) error {
-	now := time.Now()
-	date := now.Format(ISODateFormat)
+// Registry identifies the source that an image is coming from.
+type Registry string
 
-	// get pods in all the namespaces
-	pods, err := clientset.CoreV1().Pods("").List(metav1.ListOptions{})
-	if err != nil {
-		return err
+// Acceptable values for Registry. These match the keys of ImageReport in its
+// JSON representation.
+const (
+	RegistryKeppel Registry = "keppel"
+	// Note: here Quay refers to the self-hosted Quay, not the public Quay.io
+	RegistryQuay      Registry = "quay"
+	RegistryDockerHub Registry = "docker_hub"
+	RegistryMisc      Registry = "misc"
+)
+
+// AllRegistries lists all Registry values in the order in which they are
+// presented to the user.
+var AllRegistries = []Registry{RegistryQuay, RegistryKeppel, RegistryDockerHub, RegistryMisc}
+
+// DisplayName returns the human-readable name of this registry.
+func (r Registry) DisplayName() string {
+	switch r {
+	case RegistryKeppel:
+		return "Keppel"
+	case RegistryQuay:
+		return "Quay"
+	case RegistryDockerHub:
+		return "Docker Hub"
+	default:
+		return "Misc."
+	}
+}
+
+// ClassifyImage determines which registry the given image is coming from.
+func ClassifyImage(image string) Registry {
+	matchList := imageFormatRx.FindStringSubmatch(image)
+	if matchList != nil {
+		switch matchList[1] {
+		case "keppel":
+			return RegistryKeppel
+		case "hub":
+			return RegistryQuay
+		default:
+			return RegistryMisc
+		}
 	}
-	logg.Info("%d pods scanned", len(pods.Items))
+	if dockerHubRx.MatchString(image) {
+		return RegistryDockerHub
+	}
+	return RegistryMisc
+}
 
-	var result ScanResult
-	result.ScrapedAt = now.Unix()
+// Bounds for the delay between retries of failed cluster scans.
+const (
+	defaultRetryBackoff = 30 * time.Second
+	maxRetryBackoff     = 10 * time.Minute
+)
 
-	// get all images
-	allImgs := make(map[string][]string)
-	for _, pod := range pods.Items {
-		ns := pod.ObjectMeta.GetNamespace()
-		podName := pod.ObjectMeta.GetName()
-		for _, c := range pod.Spec.Containers {
-			n := fmt.Sprintf("%s/%s/%s", ns, podName, c.Name)
-			allImgs[c.Image] = append(allImgs[c.Image], n)
+// ScanCluster scans a cluster for all the pods, processes the information,
+// and saves it to the database's storage. Failed attempts are retried with
+// exponential backoff as configured in db.ScanOptions, and each attempt is
+// recorded in db.ScanAttempts.
+func (db *Database) ScanCluster(ctx context.Context, clientset kubernetes.Interface) error {
+	backoff := db.ScanOptions.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := db.scanClusterAttempt(ctx, clientset)
+		if err == nil || attempt > db.ScanOptions.Retries || ctx.Err() != nil {
+			return err
 		}
-		for _, c := range pod.Spec.InitContainers {
-			n := fmt.Sprintf("%s/%s/%s", ns, podName, c.Name)
-			allImgs[c.Image] = append(allImgs[c.Image], n)
+		logg.Error("cluster scan attempt %d failed, retrying in %s: %s", attempt, backoff, err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
 		}
 	}
+}
 
-	// determine image registry and sort the date alphabetically
-	keys := make([]string, 0, len(allImgs))
-	for k := range allImgs {
-		keys = append(keys, k)
+// scanClusterAttempt performs a single scan with the configured timeout, and
+// records its outcome.
+func (db *Database) scanClusterAttempt(ctx context.Context, clientset kubernetes.Interface) error {
+	ctx, cancel := withGracePeriod(ctx, db.ScanOptions.ShutdownGracePeriod)
+	defer cancel()
+	if db.ScanOptions.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, db.ScanOptions.Timeout)
+		defer cancel()
 	}
-	sort.Strings(keys)
 
-	var imgReport ImageReport
-	for _, v := range keys {
-		cntrs := allImgs[v]
-		sort.Strings(cntrs)
-
-		matchList := imageFormatRx.FindStringSubmatch(v)
-		if matchList != nil {
-			switch matchList[1] {
-			case "keppel":
-				imgReport.Keppel = append(imgReport.Keppel, Image{Name: v, Containers: cntrs})
-			case "hub":
-				imgReport.Quay = append(imgReport.Quay, Image{Name: v, Containers: cntrs})
-			default:
-				imgReport.Misc = append(imgReport.Misc, Image{Name: v, Containers: cntrs})
+	attempt := ScanAttempt{StartedAt: time.Now()}
+	db.RW.Lock()
+	db.health.attemptStartedAt = attempt.StartedAt
+	db.RW.Unlock()
+	podsSeen, err := db.scanCluster(ctx, clientset, attempt.StartedAt)
+	attempt.Duration = time.Since(attempt.StartedAt).Round(time.Millisecond)
+	attempt.PodsSeen = podsSeen
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	db.recordScanAttempt(attempt)
+	return err
+}
+
+// withGracePeriod returns a context that is cancelled when the given grace
+// period has passed after the parent context expired. This allows work that
+// is in progress during a shutdown to finish.
+func withGracePeriod(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-parent.Done():
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
+
+// scanCluster does the actual work for ScanCluster. Returns the number of
+// pods seen, even if the scan failed.
+func (db *Database) scanCluster(ctx context.Context, clientset kubernetes.Interface, now time.Time) (int, error) {
+	date := now.UTC().Format(ISODateFormat)
+
+	raw := RawScan{
+		ScrapedAt:      now.Unix(),
+		TerminatedPods: db.ScanOptions.TerminatedPods.orDefault(),
+	}
+
+	// get all containers and image pull secrets from the pods in all namespaces
+	containers := rawCollector{cache: newScanCache()}
+	pullSecrets := newPullSecretCollector(clientset)
+	exclusions := make(exclusionCollector)
+	atomic.StoreInt64(&db.podsSeen, 0)
+	podCount, err := listPods(ctx, clientset, func(pod *corev1.Pod) {
+		atomic.AddInt64(&db.podsSeen, 1)
+		if reason := db.ScanOptions.exclusionReason(pod); reason != "" {
+			exclusions.add(pod.Namespace, reason)
+			return
+		}
+		if isTerminated(pod) {
+			raw.NoOfTerminatedPods++
+			switch raw.TerminatedPods {
+			case TerminatedPodsExclude:
+				return
+			case TerminatedPodsSeparate:
+				containers.addPod(pod, RawContainerTerminated)
+				containers.addEphemeralContainers(pod, RawContainerTerminated)
+				return
 			}
-		} else if dockerHubRx.MatchString(v) {
-			imgReport.DockerHub = append(imgReport.DockerHub, Image{Name: v, Containers: cntrs})
-		} else {
-			imgReport.Misc = append(imgReport.Misc, Image{Name: v, Containers: cntrs})
 		}
+		containers.addPod(pod, "")
+		containers.addEphemeralContainers(pod, RawContainerEphemeral)
+		pullSecrets.addPod(ctx, pod)
+	})
+	if err != nil {
+		return podCount, err
+	}
+	logg.Info("%d pods scanned", podCount)
+	raw.Containers = containers.containers
+	raw.Exclusions = exclusions.report()
+	if len(raw.Exclusions) > 0 {
+		excludedPods := 0
+		for _, e := range raw.Exclusions {
+			excludedPods += e.Pods
+		}
+		logg.Info("%d pods excluded from the scan", excludedPods)
 	}
-	result.NoOfImages.Keppel = len(imgReport.Keppel)
-	result.NoOfImages.Quay = len(imgReport.Quay)
-	result.NoOfImages.DockerHub = len(imgReport.DockerHub)
-	result.NoOfImages.Misc = len(imgReport.Misc)
-	result.NoOfImages.Total = result.NoOfImages.Keppel + result.NoOfImages.Quay + result.NoOfImages.DockerHub + result.NoOfImages.Misc
+
+	raw.PullSecrets = pullSecrets.report(ctx)
+	if ctx.Err() != nil {
+		//do not replace good data with results from a scan that was cut short
+		return podCount, fmt.Errorf("scan aborted: %s", ctx.Err().Error())
+	}
+
+	// images and containers that were already present in the previous scan
+	// keep their first-seen timestamp
+	db.RW.RLock()
+	prevImgs := db.Images
+	db.RW.RUnlock()
+
+	result, imgReport := raw.classify(prevImgs)
 	logg.Info("%d images found: %d from Keppel, %d from Quay, %d from Docker Hub, and %d from misc. sources",
 		result.NoOfImages.Total, result.NoOfImages.Keppel,
 		result.NoOfImages.Quay, result.NoOfImages.DockerHub, result.NoOfImages.Misc)
+	logg.Info("%d containers found: %d from Keppel, %d from Quay, %d from Docker Hub, and %d from misc. sources",
+		result.NoOfContainers.Total, result.NoOfContainers.Keppel,
+		result.NoOfContainers.Quay, result.NoOfContainers.DockerHub, result.NoOfContainers.Misc)
+	logg.Info("%d ephemeral containers and %d pods in terminal phases found (terminated pods: %s)",
+		result.NoOfEphemeralContainers, result.NoOfTerminatedPods, result.TerminatedPods)
+	logg.Info("%d image pull secrets found with credentials for Quay or Docker Hub", len(imgReport.PullSecrets))
 
 	db.RW.Lock()
 	db.DailyResults[date] = result
 	db.Images = imgReport
-	db.LastScrapeTime = now
+	db.LastScrapeTime = now.UTC()
 	db.RW.Unlock()
 	logg.Info("successfully updated the database")
 
-	// upload ScanResult and images data to Swift
-	acc, err := GetObjectStoreAccount()
-	if err != nil {
-		return err
+	// persist ScanResult and images data
+	if db.Spool != nil {
+		return podCount, db.Spool.add(result, imgReport, &raw)
 	}
-	cntr, err := acc.Container(SwiftContainerName).EnsureExists()
-	if err != nil {
-		return err
+	err = db.Storage.Save(ctx, result, &imgReport, &raw)
+	db.recordUpload(err)
+	return podCount, err
+}
+
+// podListPageSize is the maximum number of pods that are requested from the
+// API server at once.
+const podListPageSize = 500
+
+// maxPodListRestarts is how often listPods starts over when the continue
+// token expires.
+const maxPodListRestarts = 3
+
+// listPods lists the pods in all namespaces in pages of podListPageSize, and
+// calls the given function once for each pod, even if the pod is listed more
+// than once (e.g. because it moved between pages). Only one page is held in
+// memory at a time. Returns the number of pods.
+//
+// If the continue token expires (because the API server does not keep the
+// snapshot for that long), the listing starts over, and pods that were
+// already seen are skipped.
+func listPods(ctx context.Context, clientset kubernetes.Interface, fn func(*corev1.Pod)) (int, error) {
+	seen := make(map[string]bool)
+	restarts := 0
+	opts := metav1.ListOptions{Limit: podListPageSize}
+	for {
+		pods, err := clientset.CoreV1().Pods("").List(ctx, opts)
+		if apierrors.IsResourceExpired(err) && opts.Continue != "" {
+			if restarts == maxPodListRestarts {
+				return len(seen), fmt.Errorf("could not list pods: continue token expired %d times", restarts+1)
+			}
+			restarts++
+			logg.Info("continue token expired after %d pods, listing pods again", len(seen))
+			opts.Continue = ""
+			continue
+		}
+		if err != nil {
+			return len(seen), fmt.Errorf("could not list pods: %s", err.Error())
+		}
+		for idx := range pods.Items {
+			pod := &pods.Items[idx]
+			key := string(pod.UID)
+			if key == "" {
+				key = pod.Namespace + "/" + pod.Name
+			}
+			if !seen[key] {
+				seen[key] = true
+				fn(pod)
+			}
+		}
+		if pods.Continue == "" {
+			return len(seen), nil
+		}
+		opts.Continue = pods.Continue
 	}
+}
 
-	b, err := json.Marshal(result)
-	if err != nil {
-		return err
+// scanCache deduplicates strings that occur in many containers (e.g. image
+// names and IDs from the pod status), so that each distinct value is only
+// held in memory once. It also remembers the results of image classification,
+// which is expensive compared to the rest of the scan.
+type scanCache struct {
+	strings    map[string]string
+	registries map[string]Registry
+	mismatches map[[3]string]string
+}
+
+func newScanCache() *scanCache {
+	return &scanCache{
+		strings:    make(map[string]string),
+		registries: make(map[string]Registry),
+		mismatches: make(map[[3]string]string),
 	}
-	n := filepath.Join(ScanResultPrefix, date)
-	obj := cntr.Object(n)
-	err = obj.Upload(bytes.NewReader(b), nil, nil)
-	if err != nil {
-		return err
+}
+
+func (sc *scanCache) intern(s string) string {
+	if s == "" {
+		return s
 	}
-	logg.Info("uploaded scan result to %s", obj.FullName())
+	if v, exists := sc.strings[s]; exists {
+		return v
+	}
+	sc.strings[s] = s
+	return s
+}
 
-	b, err = json.Marshal(struct {
-		Images ImageReport `json:"images"`
-	}{imgReport})
-	if err != nil {
-		return err
+// classify is like ClassifyImage, but caches the result.
+func (sc *scanCache) classify(image string) Registry {
+	reg, exists := sc.registries[image]
+	if !exists {
+		reg = ClassifyImage(image)
+		sc.registries[sc.intern(image)] = reg
 	}
-	obj = cntr.Object("image_data")
-	err = obj.Upload(bytes.NewReader(b), nil, nil)
-	if err != nil {
-		return err
+	return reg
+}
+
+// imageMismatch is like the function of the same name, but caches the result.
+func (sc *scanCache) imageMismatch(specImage, statusImage, imageID string) string {
+	key := [3]string{specImage, statusImage, imageID}
+	result, exists := sc.mismatches[key]
+	if !exists {
+		result = sc.intern(imageMismatch(specImage, statusImage, imageID))
+		sc.mismatches[[3]string{sc.intern(specImage), sc.intern(statusImage), sc.intern(imageID)}] = result
 	}
-	logg.Info("uploaded image data to %s", obj.FullName())
+	return result
+}
 
-	return nil
+// imageCollector maps image names to the locations where they are used.
+type imageCollector struct {
+	containers map[string][]Container
+	cache      *scanCache
+}
+
+func newImageCollector(cache *scanCache) *imageCollector {
+	return &imageCollector{containers: make(map[string][]Container), cache: cache}
+}
+
+func (ic *imageCollector) add(image string, cntr Container) {
+	image = ic.cache.intern(image)
+	ic.containers[image] = append(ic.containers[image], cntr)
+}
+
+// addPodSpec records the images of all containers in the given pod spec.
+func (ic *imageCollector) addPodSpec(namespace, podName string, spec corev1.PodSpec, source string) {
+	for _, c := range spec.Containers {
+		n := namespace + "/" + podName + "/" + c.Name
+		ic.add(c.Image, Container{Name: n, Source: ic.cache.intern(source)})
+	}
+	for _, c := range spec.InitContainers {
+		n := namespace + "/" + podName + "/" + c.Name
+		ic.add(c.Image, Container{Name: n, Source: ic.cache.intern(source)})
+	}
+}
+
+// isTerminated checks whether the pod is in a terminal phase, i.e. none of
+// its containers will be (re)started anymore.
+func isTerminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// addRawContainer records the image of a container found by a cluster scan,
+// and compares it to the image that the container is actually running.
+func (ic *imageCollector) addRawContainer(rc RawContainer) {
+	cntr := Container{Name: rc.Name, Workload: ic.cache.intern(workloadOf(rc.Owner))}
+	if rc.StatusImage != "" {
+		cntr.StatusImage = ic.cache.intern(rc.StatusImage)
+		cntr.ImageID = ic.cache.intern(rc.ImageID)
+		cntr.StatusRegistry = ic.cache.classify(normalizeStatusImage(rc.StatusImage))
+		cntr.Mismatch = ic.cache.imageMismatch(rc.Image, rc.StatusImage, rc.ImageID)
+	}
+	ic.add(rc.Image, cntr)
+}
+
+// normalizeStatusImage removes the explicit Docker Hub hostname that container
+// runtimes add to image names in the pod status (e.g. "nginx:1.17" is
+// reported as "docker.io/library/nginx:1.17"), so that the image is classified
+// in the same way as in the pod spec.
+func normalizeStatusImage(image string) string {
+	fields := strings.SplitN(image, "/", 2)
+	if len(fields) == 2 && dockerHubHosts[fields[0]] {
+		return fields[1]
+	}
+	return image
+}
+
+// imageMismatch describes how the image that a container is actually running
+// differs from the image in its spec, or returns an empty string if there is
+// no relevant difference.
+func imageMismatch(specImage, statusImage, imageID string) string {
+	//some runtimes report the image ID instead of the image name
+	if !strings.HasPrefix(statusImage, "sha256:") {
+		specReg := ClassifyImage(specImage)
+		statusReg := ClassifyImage(normalizeStatusImage(statusImage))
+		if specReg != statusReg {
+			return fmt.Sprintf("spec refers to %s, but image was pulled from %s",
+				specReg.DisplayName(), statusReg.DisplayName())
+		}
+	}
+
+	//digests can only be compared if the spec pins one, and if the image ID
+	//contains the repo digest (e.g. "docker-pullable://repo@sha256:...")
+	specDigest := digestOf(specImage)
+	statusDigest := digestOf(imageID)
+	if specDigest != "" && statusDigest != "" && specDigest != statusDigest {
+		return fmt.Sprintf("spec pins digest %s, but running digest is %s", specDigest, statusDigest)
+	}
+	return ""
+}
+
+// digestOf returns the digest part of an image reference like
+// "repo@sha256:...", or an empty string if there is none.
+func digestOf(ref string) string {
+	idx := strings.LastIndex(ref, "@")
+	if idx < 0 {
+		return ""
+	}
+	return ref[idx+1:]
+}
+
+// removedRetention is how long images and locations that are gone are kept
+// in ImageReport.Removed.
+const removedRetention = 7 * 24 * 60 * 60 // seconds
+
+// report classifies the collected images by registry, and sorts them
+// alphabetically. If now is non-zero, first-seen and last-seen timestamps are
+// filled in, and first-seen timestamps are carried over from images and
+// containers that are present in the previous report. Containers are matched
+// by workload where possible, so that their first-seen timestamps survive
+// rollouts. Images and locations from the previous report that are gone are
+// moved into the Removed list.
+func (ic *imageCollector) report(prev ImageReport, now int64) ImageReport {
+	var imgReport ImageReport
+	images := ic.images(prev.registryImages(), now)
+	for _, img := range images {
+		imgReport.Add(ClassifyImage(img.Name), img)
+	}
+	if now != 0 {
+		imgReport.Removed = removedImages(append(prev.registryImages(), prev.Removed...), images, now)
+	}
+	return imgReport
+}
+
+// removedImages returns the locations from the previous images that are not
+// among the current images, grouped by image and sorted alphabetically.
+// Locations that were last seen more than removedRetention ago are dropped.
+func removedImages(prev, current []Image, now int64) []Image {
+	present := make(map[string]bool)
+	for _, img := range current {
+		for _, c := range img.Containers {
+			present[img.Name+"\x00"+c.workloadKey()] = true
+			present[img.Name+"\x00"+c.Name] = true
+		}
+	}
+
+	removed := make(map[string]*Image)
+	seen := make(map[string]int) // index of each location in its image
+	for _, img := range prev {
+		for _, c := range img.Containers {
+			key := img.Name + "\x00" + c.workloadKey()
+			//reports from older versions do not have last-seen timestamps, and
+			//when old scans are rebuilt, the previous report can be newer
+			if present[key] || present[img.Name+"\x00"+c.Name] || c.LastSeen == 0 ||
+				c.LastSeen >= now || now-c.LastSeen > removedRetention {
+				continue
+			}
+			r := removed[img.Name]
+			if r == nil {
+				r = &Image{Name: img.Name}
+				removed[img.Name] = r
+			}
+			if idx, exists := seen[key]; exists {
+				//several pods of the same workload: keep the latest one
+				if r.Containers[idx].LastSeen < c.LastSeen {
+					r.Containers[idx] = c
+				}
+			} else {
+				seen[key] = len(r.Containers)
+				r.Containers = append(r.Containers, c)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(removed))
+	for name := range removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]Image, 0, len(names))
+	for _, name := range names {
+		img := removed[name]
+		sort.Slice(img.Containers, func(i, j int) bool {
+			return img.Containers[i].Name < img.Containers[j].Name
+		})
+		for _, c := range img.Containers {
+			if img.FirstSeen == 0 || (c.FirstSeen != 0 && c.FirstSeen < img.FirstSeen) {
+				img.FirstSeen = c.FirstSeen
+			}
+			if c.LastSeen > img.LastSeen {
+				img.LastSeen = c.LastSeen
+			}
+		}
+		result = append(result, *img)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// images returns the collected images sorted alphabetically, without
+// classifying them. Timestamps are handled like in report().
+func (ic *imageCollector) images(prev []Image, now int64) []Image {
+	keys := make([]string, 0, len(ic.containers))
+	for k := range ic.containers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	prevImgs := make(map[string]Image, len(prev))
+	for _, img := range prev {
+		prevImgs[img.Name] = img
+	}
+
+	var result []Image
+	for _, v := range keys {
+		cntrs := ic.containers[v]
+		sort.Slice(cntrs, func(i, j int) bool {
+			if cntrs[i].Name != cntrs[j].Name {
+				return cntrs[i].Name < cntrs[j].Name
+			}
+			return cntrs[i].Source < cntrs[j].Source
+		})
+		cntrs = dedupContainers(cntrs)
+
+		img := Image{Name: v, Containers: cntrs}
+		if now != 0 {
+			prevImg, exists := prevImgs[v]
+			//earliest first-seen timestamp by location and by workload (reports
+			//from older versions do not have workloads)
+			prevFirstSeen := make(map[string]int64, 2*len(prevImg.Containers))
+			for _, c := range prevImg.Containers {
+				for _, key := range []string{c.Name, c.workloadKey()} {
+					if t, exists := prevFirstSeen[key]; c.FirstSeen != 0 && (!exists || c.FirstSeen < t) {
+						prevFirstSeen[key] = c.FirstSeen
+					}
+				}
+			}
+
+			img.FirstSeen, img.LastSeen = now, now
+			//when old scans are rebuilt, the previous report can be newer
+			if exists && prevImg.FirstSeen != 0 && prevImg.FirstSeen < now {
+				img.FirstSeen = prevImg.FirstSeen
+			}
+			for idx, c := range img.Containers {
+				c.FirstSeen, c.LastSeen = now, now
+				for _, key := range []string{c.workloadKey(), c.Name} {
+					if t := prevFirstSeen[key]; t != 0 && t < now {
+						c.FirstSeen = t
+						break
+					}
+				}
+				img.Containers[idx] = c
+			}
+		}
+		result = append(result, img)
+	}
+	return result
+}
+
+// dedupContainers removes duplicate locations from the given sorted slice.
+func dedupContainers(cntrs []Container) []Container {
+	if len(cntrs) < 2 {
+		return cntrs
+	}
+	result := cntrs[:1]
+	for _, c := range cntrs[1:] {
+		last := result[len(result)-1]
+		if c.Name != last.Name || c.Source != last.Source {
+			result = append(result, c)
+		}
+	}
+	return result
 }
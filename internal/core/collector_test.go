@@ -0,0 +1,258 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func imageNames(images []Image) []string {
+	var result []string
+	for _, img := range images {
+		result = append(result, img.Name)
+	}
+	return result
+}
+
+func containerNames(img Image) []string {
+	var result []string
+	for _, c := range img.Containers {
+		result = append(result, c.Name)
+	}
+	return result
+}
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	return &Database{
+		DailyResults: make(map[string]ScanResult),
+		Storage:      &MemoryStorage{},
+	}
+}
+
+func TestScanClusterWithFixture(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db := newTestDatabase(t)
+	err = db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	assert.DeepEqual(t, "Keppel images", imageNames(db.Images.Keppel), []string{
+		"keppel.eu-de-1.cloud.sap/ccloud/loci-keystone:stein-20200401",
+		"keppel.eu-de-1.cloud.sap/ccloud/rabbitmq:3.7",
+	})
+	assert.DeepEqual(t, "Quay images", imageNames(db.Images.Quay), []string{
+		"hub.global.cloud.sap/monsoon/swift-collector:20200302",
+		"hub.global.cloud.sap/monsoon/swift-proxy:rocky-20200115",
+	})
+	assert.DeepEqual(t, "Docker Hub images", imageNames(db.Images.DockerHub), []string{
+		"prom/statsd-exporter:v0.15.0",
+	})
+	assert.DeepEqual(t, "Misc images", imageNames(db.Images.Misc), []string{
+		"quay.io/kubernetes-ingress-controller/nginx-ingress-controller:0.26.1",
+	})
+	assert.DeepEqual(t, "Keppel containers", containerNames(db.Images.Keppel[0]), []string{
+		"monsoon3/keystone-api-5d8f7b9c4-p9zvd/keystone-api",
+		"monsoon3/keystone-api-5d8f7b9c4-x2k8q/db-migrate",
+		"monsoon3/keystone-api-5d8f7b9c4-x2k8q/keystone-api",
+	})
+
+	assert.DeepEqual(t, "mismatches", db.Images.Mismatches(), []ImageMismatch{{
+		SpecImage: "keppel.eu-de-1.cloud.sap/ccloud/loci-keystone:stein-20200401",
+		Container: db.Images.Keppel[0].Containers[0],
+	}})
+	assert.DeepEqual(t, "mismatch", db.Images.Keppel[0].Containers[0].Mismatch,
+		"spec refers to Keppel, but image was pulled from Quay")
+	assert.DeepEqual(t, "status registry", db.Images.DockerHub[0].Containers[0].StatusRegistry, RegistryDockerHub)
+
+	assert.DeepEqual(t, "pull secrets", db.Images.PullSecrets, []PullSecret{{
+		Name:            "swift/quay-pull-secret",
+		Registries:      []string{"hub.global.cloud.sap"},
+		ServiceAccounts: []string{"swift/swift-proxy"},
+	}})
+
+	result := db.DailyResults[db.LastScrapeTime.Format(ISODateFormat)]
+	assert.DeepEqual(t, "total images", result.NoOfImages.Total, 6)
+	assert.DeepEqual(t, "Keppel images", result.NoOfImages.Keppel, 2)
+	assert.DeepEqual(t, "Quay images", result.NoOfImages.Quay, 2)
+	assert.DeepEqual(t, "Docker Hub images", result.NoOfImages.DockerHub, 1)
+	assert.DeepEqual(t, "Misc images", result.NoOfImages.Misc, 1)
+	assert.DeepEqual(t, "containers", result.NoOfContainers, Counts{Total: 9, Keppel: 4, Quay: 2, DockerHub: 2, Misc: 1})
+	assert.DeepEqual(t, "pods", result.NoOfPods, Counts{Total: 5, Keppel: 3, Quay: 1, DockerHub: 2, Misc: 1})
+	assert.DeepEqual(t, "exclusions", result.Exclusions, []Exclusion{
+		{Namespace: "monsoon3", Reason: ExcludedByAnnotation, Pods: 1},
+	})
+	assert.DeepEqual(t, "ephemeral containers", result.NoOfEphemeralContainers, 1)
+	assert.DeepEqual(t, "terminated pods", result.NoOfTerminatedPods, 1)
+
+	// ephemeral containers and terminated pods are reported separately
+	assert.DeepEqual(t, "ephemeral images", imageNames(db.Images.Ephemeral), []string{"busybox:1.31"})
+	assert.DeepEqual(t, "ephemeral containers", containerNames(db.Images.Ephemeral[0]), []string{
+		"monsoon3/rabbitmq-0/debugger",
+	})
+	assert.DeepEqual(t, "terminated images", imageNames(db.Images.Terminated), []string{
+		"hub.global.cloud.sap/monsoon/backup-tools:20200310",
+	})
+
+	// the scan result must have been persisted
+	storage := db.Storage.(*MemoryStorage)
+	assert.DeepEqual(t, "stored scan results", len(storage.DailyResults), 1)
+	assert.DeepEqual(t, "stored images", storage.Images, db.Images)
+}
+
+func TestScanClusterTerminatedPodsModes(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Mode       TerminatedPodsMode
+		QuayImages int
+		Pods       int
+	}{
+		{TerminatedPodsExclude, 2, 5},
+		{TerminatedPodsInclude, 3, 6},
+	}
+	for _, tc := range testCases {
+		db := newTestDatabase(t)
+		db.ScanOptions.TerminatedPods = tc.Mode
+		err = db.ScanCluster(context.Background(), clientset)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result := db.DailyResults[db.LastScrapeTime.Format(ISODateFormat)]
+		assert.DeepEqual(t, string(tc.Mode)+": Quay images", result.NoOfImages.Quay, tc.QuayImages)
+		assert.DeepEqual(t, string(tc.Mode)+": pods", result.NoOfPods.Total, tc.Pods)
+		assert.DeepEqual(t, string(tc.Mode)+": terminated images", len(db.Images.Terminated), 0)
+	}
+}
+
+func TestImageMismatch(t *testing.T) {
+	digest1 := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	digest2 := "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	testCases := []struct {
+		SpecImage   string
+		StatusImage string
+		ImageID     string
+		Expected    string
+	}{
+		{"library/nginx:1.17", "docker.io/library/nginx:1.17", "docker-pullable://nginx@" + digest1, ""},
+		{"library/nginx:1.17", digest1, "docker://" + digest1, ""},
+		{"library/nginx@" + digest1, "docker.io/library/nginx@" + digest1, "docker-pullable://nginx@" + digest1, ""},
+		{"library/nginx@" + digest1, "docker.io/library/nginx@" + digest1, "docker-pullable://nginx@" + digest2,
+			"spec pins digest " + digest1 + ", but running digest is " + digest2},
+		{"library/nginx:1.17", "keppel.eu-de-1.cloud.sap/ccloud-dockerhub-mirror/library/nginx:1.17", "",
+			"spec refers to Docker Hub, but image was pulled from Keppel"},
+	}
+	for _, tc := range testCases {
+		actual := imageMismatch(tc.SpecImage, tc.StatusImage, tc.ImageID)
+		assert.DeepEqual(t, "mismatch for "+tc.StatusImage, actual, tc.Expected)
+	}
+}
+
+func TestScanClusterKeepsFirstSeen(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db := newTestDatabase(t)
+
+	// pretend that one of the images and one of its containers were already
+	// seen a while ago
+	firstSeen := time.Now().Add(-48 * time.Hour).Unix()
+	db.Images.Quay = []Image{{
+		Name:      "hub.global.cloud.sap/monsoon/swift-proxy:rocky-20200115",
+		FirstSeen: firstSeen,
+		Containers: []Container{{
+			Name:      "swift/swift-proxy-cluster-3-7d9f8c6b5-lmn4r/proxy",
+			FirstSeen: firstSeen,
+		}},
+	}}
+
+	err = db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := db.LastScrapeTime.Unix()
+
+	for _, img := range db.Images.Quay {
+		expected := now
+		if img.Name == "hub.global.cloud.sap/monsoon/swift-proxy:rocky-20200115" {
+			expected = firstSeen
+			assert.DeepEqual(t, "container first seen", img.Containers[0].FirstSeen, firstSeen)
+		}
+		assert.DeepEqual(t, img.Name+" first seen", img.FirstSeen, expected)
+	}
+}
+
+func TestScanClusterRetries(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the first listing fails, all later ones succeed
+	failures := 1
+	clientset.(*fake.Clientset).PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failures > 0 {
+			failures--
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	db := newTestDatabase(t)
+	db.ScanOptions.Retries = 2
+	db.ScanOptions.RetryBackoff = time.Millisecond
+	err = db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "scan attempts", len(db.ScanAttempts), 2)
+	assert.DeepEqual(t, "first attempt", db.ScanAttempts[0].Error, "could not list pods: connection refused")
+	assert.DeepEqual(t, "second attempt", db.ScanAttempts[1].Error, "")
+	assert.DeepEqual(t, "pods seen", db.ScanAttempts[1].PodsSeen, 7)
+
+	// when all attempts fail, the error is returned and the data is kept
+	failures = 3
+	err = db.ScanCluster(context.Background(), clientset)
+	if err == nil {
+		t.Fatal("expected scan to fail")
+	}
+	assert.DeepEqual(t, "scan attempts", len(db.ScanAttempts), 5)
+	assert.DeepEqual(t, "images", len(db.Images.Keppel), 2)
+
+	// retries stop when the context is cancelled
+	failures = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.ScanCluster(ctx, clientset)
+	if err == nil {
+		t.Fatal("expected scan to fail")
+	}
+	assert.DeepEqual(t, "scan attempts", len(db.ScanAttempts), 6)
+}
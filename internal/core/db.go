@@ -15,11 +15,17 @@
 package core
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
-// ISODateFormat is what it is.
+// ISODateFormat is what it is. Dates are always formatted in UTC, so that the
+// keys of DailyResults and the objects in Swift do not depend on the time zone.
 const ISODateFormat = "2006-01-02"
 
 // Database is the in-memory database that persists for the duration of the
@@ -29,19 +35,197 @@ type Database struct {
 	DailyResults   map[string]ScanResult // map of date (ISO format) to ScanResult
 	Images         ImageReport
 	LastScrapeTime time.Time
+	Storage        Storage
+	// If not nil, scan results are written to the spool first, and uploaded
+	// to the Storage by RunUploader.
+	Spool       *Spool
+	ScanOptions ScanOptions
+	// The most recent scan attempts, oldest first.
+	ScanAttempts []ScanAttempt
+	// The total number of scan attempts, including those that were dropped
+	// from ScanAttempts.
+	scanAttemptCount int
+	// The number of pods seen so far by the running scan attempt. Accessed
+	// atomically.
+	podsSeen int64
+	health   healthState
+}
+
+// maxScanAttempts is the number of scan attempts that are remembered.
+const maxScanAttempts = 20
+
+// ScanAttempt records the outcome of a single attempt of a cluster scan.
+type ScanAttempt struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	PodsSeen  int
+	// Empty if the attempt was successful.
+	Error string
+}
+
+func (db *Database) recordScanAttempt(attempt ScanAttempt) {
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	db.ScanAttempts = append(db.ScanAttempts, attempt)
+	db.scanAttemptCount++
+	db.health.attemptStartedAt = time.Time{}
+	if attempt.Error == "" {
+		db.health.scanFailures = 0
+		db.health.lastScanError = ""
+		db.health.lastSuccessfulScanAt = attempt.StartedAt.Add(attempt.Duration)
+	} else {
+		db.health.scanFailures++
+		db.health.lastScanError = attempt.Error
+	}
+	if len(db.ScanAttempts) > maxScanAttempts {
+		db.ScanAttempts = db.ScanAttempts[len(db.ScanAttempts)-maxScanAttempts:]
+	}
 }
 
 // ScanResult holds the processed data for a single cluster scan.
 type ScanResult struct {
-	ScrapedAt  int64 `json:"scraped_at"` // UTC
-	NoOfImages struct {
-		Total  int `json:"total"`
-		Keppel int `json:"keppel"`
-		// Note: here Quay refers to the self-hosted Quay, not the public Quay.io
-		Quay      int `json:"quay"`
-		DockerHub int `json:"docker_hub"`
-		Misc      int `json:"misc"`
-	} `json:"no_of_images"`
+	ScrapedAt  int64  `json:"scraped_at"` // UTC
+	NoOfImages Counts `json:"no_of_images"`
+	// Containers and pods are only counted since this field was introduced, so
+	// older scan results have all zeroes here.
+	NoOfContainers Counts `json:"no_of_containers"`
+	// A pod is counted once for every registry that it uses images from, so
+	// Total can be smaller than the sum of the per-registry counts.
+	NoOfPods Counts `json:"no_of_pods"`
+	// Containers counted by the registry that their running image was pulled
+	// from according to the pod status (see Container.StatusRegistry).
+	// Containers without a status, or whose runtime only reports an image ID,
+	// are counted by their spec.
+	NoOfRunningContainers Counts `json:"no_of_running_containers"`
+	// Containers whose running image differs from the image in their spec
+	// (see Container.Mismatch).
+	NoOfMismatchedContainers int `json:"no_of_mismatched_containers"`
+	// Ephemeral containers are not included in the counts above.
+	NoOfEphemeralContainers int `json:"no_of_ephemeral_containers"`
+	// Pods in terminal phases are only included in the counts above if
+	// TerminatedPods is TerminatedPodsInclude.
+	NoOfTerminatedPods int                `json:"no_of_terminated_pods"`
+	TerminatedPods     TerminatedPodsMode `json:"terminated_pods,omitempty"`
+	// Pods that were excluded by the ScanOptions, grouped by namespace and
+	// reason. These pods are not included in any of the counts above.
+	Exclusions []Exclusion `json:"exclusions,omitempty"`
+}
+
+// ScanOptions configures which pods and containers are considered by
+// ScanCluster.
+type ScanOptions struct {
+	TerminatedPods TerminatedPodsMode
+	// If not empty, only namespaces matching one of these shell glob patterns
+	// are scanned.
+	IncludeNamespaces []string
+	// Namespaces matching one of these shell glob patterns are never scanned.
+	// This takes precedence over IncludeNamespaces.
+	ExcludeNamespaces []string
+	// If not nil, only pods matching this selector are scanned.
+	PodSelector labels.Selector
+	// Maximum duration of a single scan attempt. Zero means no timeout.
+	Timeout time.Duration
+	// Number of times that a failed scan is retried.
+	Retries int
+	// Delay before the first retry. It is doubled for each further retry.
+	RetryBackoff time.Duration
+	// When the context given to ScanCluster expires, a running scan attempt
+	// gets this much time to finish and save its result before it is
+	// cancelled. Failed attempts are not retried after the context expired.
+	ShutdownGracePeriod time.Duration
+}
+
+// TerminatedPodsMode determines how ScanCluster handles pods in the Succeeded
+// or Failed phase.
+type TerminatedPodsMode string
+
+// Acceptable values for TerminatedPodsMode.
+const (
+	// TerminatedPodsSeparate reports the images of terminated pods in a
+	// separate list. This is the default.
+	TerminatedPodsSeparate TerminatedPodsMode = "separate"
+	// TerminatedPodsExclude ignores terminated pods entirely.
+	TerminatedPodsExclude TerminatedPodsMode = "exclude"
+	// TerminatedPodsInclude treats terminated pods like running pods.
+	TerminatedPodsInclude TerminatedPodsMode = "include"
+)
+
+// ParseTerminatedPodsMode parses a TerminatedPodsMode from user input.
+func ParseTerminatedPodsMode(input string) (TerminatedPodsMode, error) {
+	switch m := TerminatedPodsMode(input); m {
+	case TerminatedPodsSeparate, TerminatedPodsExclude, TerminatedPodsInclude:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid value for terminated pods: %q (expected \"separate\", \"exclude\" or \"include\")", input)
+	}
+}
+
+func (m TerminatedPodsMode) orDefault() TerminatedPodsMode {
+	if m == "" {
+		return TerminatedPodsSeparate
+	}
+	return m
+}
+
+// Counts holds the number of images, containers or pods per registry.
+type Counts struct {
+	Total  int `json:"total"`
+	Keppel int `json:"keppel"`
+	// Note: here Quay refers to the self-hosted Quay, not the public Quay.io
+	Quay      int `json:"quay"`
+	DockerHub int `json:"docker_hub"`
+	Misc      int `json:"misc"`
+}
+
+// Get returns the count for the given registry.
+func (c Counts) Get(reg Registry) int {
+	switch reg {
+	case RegistryKeppel:
+		return c.Keppel
+	case RegistryQuay:
+		return c.Quay
+	case RegistryDockerHub:
+		return c.DockerHub
+	default:
+		return c.Misc
+	}
+}
+
+// Add increases the count for the given registry (but not the total).
+func (c *Counts) Add(reg Registry, n int) {
+	switch reg {
+	case RegistryKeppel:
+		c.Keppel += n
+	case RegistryQuay:
+		c.Quay += n
+	case RegistryDockerHub:
+		c.DockerHub += n
+	default:
+		c.Misc += n
+	}
+}
+
+// CountImages fills NoOfImages and NoOfContainers from the given image report.
+func (r *ScanResult) CountImages(images ImageReport) {
+	r.NoOfImages = Counts{}
+	r.NoOfContainers = Counts{}
+	r.NoOfRunningContainers = Counts{}
+	r.NoOfMismatchedContainers = 0
+	for _, reg := range AllRegistries {
+		for _, img := range images.Get(reg) {
+			r.NoOfImages.Add(reg, 1)
+			r.NoOfContainers.Add(reg, len(img.Containers))
+			for _, c := range img.Containers {
+				r.NoOfRunningContainers.Add(c.runningRegistry(reg), 1)
+				if c.Mismatch != "" {
+					r.NoOfMismatchedContainers++
+				}
+			}
+		}
+		r.NoOfImages.Total += r.NoOfImages.Get(reg)
+		r.NoOfContainers.Total += r.NoOfContainers.Get(reg)
+	}
+	r.NoOfRunningContainers.Total = r.NoOfContainers.Total
 }
 
 // ImageReport holds the data for all the images.
@@ -50,11 +234,210 @@ type ImageReport struct {
 	Quay      []Image `json:"quay"`
 	DockerHub []Image `json:"docker_hub"`
 	Misc      []Image `json:"misc"`
+	// Images of ephemeral containers and of pods in terminal phases are
+	// reported separately regardless of their registry, and are not included
+	// in the lists above.
+	Ephemeral  []Image `json:"ephemeral,omitempty"`
+	Terminated []Image `json:"terminated,omitempty"`
+	// Images and locations that were found by earlier scans within
+	// removedRetention, but not by the latest one. They are not included in
+	// the lists above.
+	Removed []Image `json:"removed,omitempty"`
+	// Image pull secrets are only reported by cluster scans.
+	PullSecrets []PullSecret `json:"pull_secrets,omitempty"`
+}
+
+// Get returns the images that are coming from the given registry.
+func (r ImageReport) Get(reg Registry) []Image {
+	switch reg {
+	case RegistryKeppel:
+		return r.Keppel
+	case RegistryQuay:
+		return r.Quay
+	case RegistryDockerHub:
+		return r.DockerHub
+	default:
+		return r.Misc
+	}
+}
+
+// Add appends an image to the list for the given registry.
+func (r *ImageReport) Add(reg Registry, img Image) {
+	switch reg {
+	case RegistryKeppel:
+		r.Keppel = append(r.Keppel, img)
+	case RegistryQuay:
+		r.Quay = append(r.Quay, img)
+	case RegistryDockerHub:
+		r.DockerHub = append(r.DockerHub, img)
+	default:
+		r.Misc = append(r.Misc, img)
+	}
 }
 
 // Image holds the data for a specific image.
 type Image struct {
-	Name string `json:"name"`
+	Name       string      `json:"name"`
+	FirstSeen  int64       `json:"first_seen,omitempty"` // UTC
+	LastSeen   int64       `json:"last_seen,omitempty"`  // UTC
+	Containers []Container `json:"containers"`
+}
+
+// Container holds the data for a specific location where an image is used.
+type Container struct {
 	// Container names are in the form: namespace/pod/container
-	Containers []string `json:"containers"`
+	Name      string `json:"name"`
+	FirstSeen int64  `json:"first_seen,omitempty"` // UTC
+	LastSeen  int64  `json:"last_seen,omitempty"`  // UTC
+	// The workload that the pod belongs to, e.g. "Deployment/keystone-api".
+	// Only set for containers found in a cluster scan, if the pod has a
+	// controller.
+	Workload string `json:"workload,omitempty"`
+	// Source is only set for containers found in manifest files. It contains
+	// the file path and the kind of the object that contains the pod spec.
+	Source string `json:"source,omitempty"`
+	// The following fields are only set for containers found in a cluster
+	// scan, and only if the pod status reports the container. They describe
+	// the image that is actually running, which can differ from the image in
+	// the pod spec because of mutating webhooks, registry mirrors or tags
+	// that were moved.
+	StatusImage    string   `json:"status_image,omitempty"`
+	ImageID        string   `json:"image_id,omitempty"`
+	StatusRegistry Registry `json:"status_registry,omitempty"`
+	// Mismatch describes how the running image differs from the image in the
+	// pod spec. It is empty if they refer to the same registry and digest.
+	Mismatch string `json:"mismatch,omitempty"`
+}
+
+// runningRegistry returns the registry that the running image of this
+// container was pulled from, or the given registry of its spec image if the
+// pod status does not tell.
+func (c Container) runningRegistry(specRegistry Registry) Registry {
+	if c.StatusImage == "" || strings.HasPrefix(c.StatusImage, "sha256:") {
+		return specRegistry
+	}
+	return c.StatusRegistry
+}
+
+// workloadKey identifies the location of this container across rollouts: Pod
+// names change with every rollout, but the workload stays the same.
+func (c Container) workloadKey() string {
+	if c.Workload == "" {
+		return c.Name
+	}
+	fields := strings.Split(c.Name, "/")
+	return fields[0] + "/" + c.Workload + "/" + fields[len(fields)-1]
+}
+
+// Namespace returns the namespace part of the container name.
+func (c Container) Namespace() string {
+	return strings.SplitN(c.Name, "/", 2)[0]
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Older backups
+// store containers as plain "namespace/pod/container" strings without any
+// timestamps, so both formats are accepted.
+func (c *Container) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*c = Container{Name: name}
+		return nil
+	}
+
+	type plain Container
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+// Mismatches returns all containers whose running image differs from the
+// image in their pod spec, together with the image from the pod spec.
+func (r ImageReport) Mismatches() []ImageMismatch {
+	var result []ImageMismatch
+	for _, reg := range AllRegistries {
+		for _, img := range r.Get(reg) {
+			for _, c := range img.Containers {
+				if c.Mismatch != "" {
+					result = append(result, ImageMismatch{img.Name, c})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// ImageMismatch is a container whose running image differs from the image in
+// its pod spec.
+type ImageMismatch struct {
+	SpecImage string
+	Container Container
+}
+
+// registryImages returns the images from all registries in a single list.
+func (r ImageReport) registryImages() []Image {
+	var result []Image
+	for _, reg := range AllRegistries {
+		result = append(result, r.Get(reg)...)
+	}
+	return result
+}
+
+// Namespaces returns the namespaces of all containers and pull secrets in
+// this report, without duplicates.
+func (r ImageReport) Namespaces() []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(namespace string) {
+		if !seen[namespace] {
+			seen[namespace] = true
+			result = append(result, namespace)
+		}
+	}
+	for _, images := range [][]Image{r.registryImages(), r.Ephemeral, r.Terminated, r.Removed} {
+		for _, img := range images {
+			for _, c := range img.Containers {
+				add(c.Namespace())
+			}
+		}
+	}
+	for _, s := range r.PullSecrets {
+		add(strings.SplitN(s.Name, "/", 2)[0])
+	}
+	return result
+}
+
+// FilterNamespaces returns a copy of this report that only contains the
+// containers and pull secrets in namespaces for which visible returns true.
+// Images without any visible containers are omitted.
+func (r ImageReport) FilterNamespaces(visible func(namespace string) bool) ImageReport {
+	filterImages := func(images []Image) []Image {
+		var result []Image
+		for _, img := range images {
+			var containers []Container
+			for _, c := range img.Containers {
+				if visible(c.Namespace()) {
+					containers = append(containers, c)
+				}
+			}
+			if len(containers) > 0 {
+				img.Containers = containers
+				result = append(result, img)
+			}
+		}
+		return result
+	}
+
+	result := ImageReport{
+		Keppel:     filterImages(r.Keppel),
+		Quay:       filterImages(r.Quay),
+		DockerHub:  filterImages(r.DockerHub),
+		Misc:       filterImages(r.Misc),
+		Ephemeral:  filterImages(r.Ephemeral),
+		Terminated: filterImages(r.Terminated),
+		Removed:    filterImages(r.Removed),
+	}
+	for _, s := range r.PullSecrets {
+		if visible(strings.SplitN(s.Name, "/", 2)[0]) {
+			result.PullSecrets = append(result.PullSecrets, s)
+		}
+	}
+	return result
 }
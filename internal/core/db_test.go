@@ -0,0 +1,64 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestFilterNamespaces(t *testing.T) {
+	report := ImageReport{
+		Keppel: []Image{
+			{Name: "keppel.example.com/ccloud/nova:1", Containers: []Container{
+				{Name: "monsoon3/nova-api/api"},
+				{Name: "team-a/nova-test/api"},
+			}},
+		},
+		Quay: []Image{
+			{Name: "quay.example.com/team-a/app:1", Containers: []Container{
+				{Name: "team-a/app/app"},
+			}},
+		},
+		Ephemeral: []Image{
+			{Name: "docker.io/library/busybox", Containers: []Container{
+				{Name: "kube-system/coredns/debugger"},
+			}},
+		},
+		PullSecrets: []PullSecret{
+			{Name: "monsoon3/quay-pull", Registries: []string{"quay.example.com"}},
+			{Name: "team-a/quay-pull", Registries: []string{"quay.example.com"}},
+			{Name: "team-b/quay-pull", Registries: []string{"quay.example.com"}},
+		},
+	}
+	assert.DeepEqual(t, "namespaces", report.Namespaces(), []string{"team-a", "monsoon3", "kube-system", "team-b"})
+
+	filtered := report.FilterNamespaces(func(namespace string) bool {
+		return namespace == "monsoon3"
+	})
+	assert.DeepEqual(t, "filtered report", filtered, ImageReport{
+		Keppel: []Image{
+			{Name: "keppel.example.com/ccloud/nova:1", Containers: []Container{
+				{Name: "monsoon3/nova-api/api"},
+			}},
+		},
+		PullSecrets: []PullSecret{
+			{Name: "monsoon3/quay-pull", Registries: []string{"quay.example.com"}},
+		},
+	})
+	//the original report is not modified
+	assert.DeepEqual(t, "containers in original report", len(report.Keppel[0].Containers), 2)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sapcc/go-bits/logg"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// DecodeObjects reads Kubernetes objects from a stream of YAML or JSON
+// documents. Multi-document YAML streams and objects of kind "List" are
+// flattened into a single list. Documents with kinds that are not known to
+// client-go (e.g. custom resources) are skipped.
+func DecodeObjects(r io.Reader) ([]runtime.Object, error) {
+	var result []runtime.Object
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs, err := decodeDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, objs...)
+	}
+}
+
+func decodeDocument(doc []byte) ([]runtime.Object, error) {
+	// skip documents that are empty or only contain comments
+	j, err := utilyaml.ToJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	if j = bytes.TrimSpace(j); len(j) == 0 || bytes.Equal(j, []byte("null")) {
+		return nil, nil
+	}
+
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(j, nil, nil)
+	if err != nil {
+		if runtime.IsNotRegisteredError(err) {
+			logg.Debug("skipping object: %s", err.Error())
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	list, ok := obj.(*corev1.List)
+	if !ok {
+		return []runtime.Object{obj}, nil
+	}
+	var result []runtime.Object
+	for idx, item := range list.Items {
+		objs, err := decodeDocument(item.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("in item %d of %s: %s", idx, gvk.Kind, err.Error())
+		}
+		result = append(result, objs...)
+	}
+	return result, nil
+}
+
+// NewFixtureClientset returns a fake clientset that is populated with the
+// objects from the given YAML or JSON file. This allows running the dashboard
+// without access to a real cluster.
+func NewFixtureClientset(path string) (kubernetes.Interface, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	objs, err := DecodeObjects(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read fixture %s: %s", path, err.Error())
+	}
+	clientset := fake.NewSimpleClientset()
+	for _, obj := range objs {
+		err := clientset.Tracker().Add(obj)
+		if err != nil {
+			return nil, fmt.Errorf("could not load fixture %s: %s", path, err.Error())
+		}
+	}
+	logg.Info("loaded %d objects from fixture %s", len(objs), path)
+	return clientset, nil
+}
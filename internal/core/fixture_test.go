@@ -0,0 +1,60 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDecodeObjects(t *testing.T) {
+	input := `
+# leading comment only document
+---
+{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "json-pod", "namespace": "default"}}
+---
+apiVersion: example.com/v1
+kind: SomeCustomResource
+metadata:
+  name: ignored
+---
+apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Pod
+    metadata:
+      name: listed-pod
+      namespace: default
+`
+	objs, err := DecodeObjects(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var names []string
+	for _, obj := range objs {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			t.Errorf("expected only pods, but got %T", obj)
+			continue
+		}
+		names = append(names, pod.Name)
+	}
+	assert.DeepEqual(t, "pod names", names, []string{"json-pod", "listed-pod"})
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import "time"
+
+// wedgeGracePeriod is how long a scan attempt may overrun twice its timeout
+// before the collector is considered wedged.
+const wedgeGracePeriod = time.Minute
+
+// Acceptable values for the Status fields in HealthReport.
+const (
+	HealthOK      = "ok"
+	HealthLoading = "loading"
+	// Some operations failed, but fewer than the configured maximum.
+	HealthDegraded = "degraded"
+	HealthFailing  = "failing"
+	// A scan attempt is running for much longer than its timeout.
+	HealthWedged = "wedged"
+)
+
+// healthState is the part of the Database that is only used for health
+// reports. It is protected by the Database's lock.
+type healthState struct {
+	historyLoaded bool
+	historyError  string
+	// zero if no scan attempt is running
+	attemptStartedAt       time.Time
+	scanFailures           int // consecutive
+	lastScanError          string
+	lastSuccessfulScanAt   time.Time
+	uploadFailures         int // consecutive
+	lastUploadError        string
+	lastSuccessfulUploadAt time.Time
+}
+
+// HealthReport describes the state of the subsystems of the dashboard.
+type HealthReport struct {
+	// False if the collector is wedged.
+	Alive bool `json:"alive"`
+	// False if the history was not loaded yet, or if too many consecutive scans
+	// or uploads have failed.
+	Ready     bool            `json:"ready"`
+	History   HistoryHealth   `json:"history"`
+	Collector CollectorHealth `json:"collector"`
+	Storage   StorageHealth   `json:"storage"`
+}
+
+// HistoryHealth describes whether the history was loaded from storage.
+type HistoryHealth struct {
+	Status string `json:"status"`
+	// The error from the last failed attempt to load the history.
+	Error string `json:"error,omitempty"`
+}
+
+// CollectorHealth describes the state of the cluster scans.
+type CollectorHealth struct {
+	Status              string `json:"status"`
+	RunningSince        int64  `json:"running_since,omitempty"`
+	LastSuccessAt       int64  `json:"last_success_at,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// StorageHealth describes the state of the uploads to storage.
+type StorageHealth struct {
+	Status string `json:"status"`
+	// The number of scans in the spool that are waiting to be uploaded.
+	SpoolDepth          int    `json:"spool_depth"`
+	LastSuccessAt       int64  `json:"last_success_at,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// LoadHistory populates the database from its storage and from the scans in
+// the spool that were not uploaded yet, and records whether this succeeded
+// for the health report.
+func (db *Database) LoadHistory() error {
+	err := db.Storage.Load(db)
+	if err == nil && db.Spool != nil {
+		err = db.Spool.replay(db)
+	}
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	if err == nil {
+		db.health.historyLoaded = true
+		db.health.historyError = ""
+	} else {
+		db.health.historyError = err.Error()
+	}
+	return err
+}
+
+func (db *Database) recordUpload(err error) {
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	if err == nil {
+		db.health.uploadFailures = 0
+		db.health.lastUploadError = ""
+		db.health.lastSuccessfulUploadAt = time.Now()
+	} else {
+		db.health.uploadFailures++
+		db.health.lastUploadError = err.Error()
+	}
+}
+
+// Health reports the state of the subsystems. The database is not ready once
+// maxFailures consecutive scan attempts or uploads have failed. If maxFailures
+// is zero, failures do not affect readiness.
+func (db *Database) Health(maxFailures int, now time.Time) HealthReport {
+	db.RW.RLock()
+	defer db.RW.RUnlock()
+	h := db.health
+	status := func(failures int) string {
+		switch {
+		case failures == 0:
+			return HealthOK
+		case maxFailures > 0 && failures >= maxFailures:
+			return HealthFailing
+		default:
+			return HealthDegraded
+		}
+	}
+
+	report := HealthReport{
+		History: HistoryHealth{Status: HealthOK},
+		Collector: CollectorHealth{
+			Status:              status(h.scanFailures),
+			ConsecutiveFailures: h.scanFailures,
+			LastError:           h.lastScanError,
+		},
+		Storage: StorageHealth{
+			Status:              status(h.uploadFailures),
+			ConsecutiveFailures: h.uploadFailures,
+			LastError:           h.lastUploadError,
+		},
+	}
+	if !h.historyLoaded {
+		report.History = HistoryHealth{Status: HealthLoading, Error: h.historyError}
+	}
+	if !h.lastSuccessfulScanAt.IsZero() {
+		report.Collector.LastSuccessAt = h.lastSuccessfulScanAt.Unix()
+	}
+	if db.Spool != nil {
+		report.Storage.SpoolDepth = db.Spool.Depth()
+	}
+	if !h.lastSuccessfulUploadAt.IsZero() {
+		report.Storage.LastSuccessAt = h.lastSuccessfulUploadAt.Unix()
+	}
+	if !h.attemptStartedAt.IsZero() {
+		report.Collector.RunningSince = h.attemptStartedAt.Unix()
+		timeout := db.ScanOptions.Timeout
+		if timeout > 0 && now.Sub(h.attemptStartedAt) > 2*timeout+wedgeGracePeriod {
+			report.Collector.Status = HealthWedged
+		}
+	}
+
+	report.Alive = report.Collector.Status != HealthWedged
+	report.Ready = report.Alive && report.History.Status == HealthOK &&
+		report.Collector.Status != HealthFailing && report.Storage.Status != HealthFailing
+	return report
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+// flakyStorage is a MemoryStorage whose uploads fail while Broken is set.
+type flakyStorage struct {
+	MemoryStorage
+	Broken bool
+}
+
+func (s *flakyStorage) Save(ctx context.Context, result ScanResult, images *ImageReport, raw *RawScan) error {
+	if s.Broken {
+		return errors.New("object store unavailable")
+	}
+	return s.MemoryStorage.Save(ctx, result, images, raw)
+}
+
+func TestHealth(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := &flakyStorage{}
+	db := newTestDatabase(t)
+	db.Storage = storage
+	now := time.Now()
+
+	//not ready until the history is loaded
+	report := db.Health(2, now)
+	assert.DeepEqual(t, "alive before loading", report.Alive, true)
+	assert.DeepEqual(t, "ready before loading", report.Ready, false)
+	assert.DeepEqual(t, "history before loading", report.History.Status, HealthLoading)
+	err = db.LoadHistory()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "ready after loading", db.Health(2, now).Ready, true)
+
+	//one failed upload degrades, two make us not ready
+	storage.Broken = true
+	for _, expected := range []string{HealthDegraded, HealthFailing} {
+		err = db.ScanCluster(context.Background(), clientset)
+		if err == nil {
+			t.Fatal("expected scan to fail")
+		}
+		report = db.Health(2, now)
+		assert.DeepEqual(t, "collector status", report.Collector.Status, expected)
+		assert.DeepEqual(t, "storage status", report.Storage, StorageHealth{
+			Status:              expected,
+			ConsecutiveFailures: report.Storage.ConsecutiveFailures,
+			LastError:           "object store unavailable",
+		})
+	}
+	assert.DeepEqual(t, "ready after failures", report.Ready, false)
+	assert.DeepEqual(t, "alive after failures", report.Alive, true)
+	assert.DeepEqual(t, "ready without failure limit", db.Health(0, now).Ready, true)
+
+	//a successful scan resets the failure counts
+	storage.Broken = false
+	err = db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	report = db.Health(2, now)
+	assert.DeepEqual(t, "ready after recovery", report.Ready, true)
+	assert.DeepEqual(t, "collector failures after recovery", report.Collector.ConsecutiveFailures, 0)
+
+	//a scan attempt that runs far beyond its timeout is wedged
+	db.ScanOptions.Timeout = time.Minute
+	db.health.attemptStartedAt = now.Add(-2 * time.Minute)
+	assert.DeepEqual(t, "alive during slow scan", db.Health(2, now).Alive, true)
+	db.health.attemptStartedAt = now.Add(-4 * time.Minute)
+	report = db.Health(2, now)
+	assert.DeepEqual(t, "alive during wedged scan", report.Alive, false)
+	assert.DeepEqual(t, "collector during wedged scan", report.Collector.Status, HealthWedged)
+}
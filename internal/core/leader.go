@@ -0,0 +1,90 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection ensures that only one of several replicas of the dashboard
+// scans the cluster and writes to storage. The replicas compete for a Lease
+// object in the coordination.k8s.io API group.
+type LeaderElection struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	LeaseName string
+	// Must be unique among the replicas, e.g. the pod name.
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	//1 while this replica holds the lease (accessed atomically)
+	leading int32
+}
+
+// IsLeader returns whether this replica currently holds the lease.
+func (le *LeaderElection) IsLeader() bool {
+	return atomic.LoadInt32(&le.leading) == 1
+}
+
+// Run takes part in the election until the given context expires, and then
+// releases the lease if this replica holds it. onStartedLeading is called
+// when this replica acquires the lease. onStoppedLeading is called when this
+// replica loses the lease before the context expires.
+func (le *LeaderElection) Run(ctx context.Context, onStartedLeading, onStoppedLeading func()) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{Namespace: le.Namespace, Name: le.LeaseName},
+		Client:    le.Clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: le.Identity,
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            le.LeaseName,
+		LeaseDuration:   le.LeaseDuration,
+		RenewDeadline:   le.RenewDeadline,
+		RetryPeriod:     le.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				atomic.StoreInt32(&le.leading, 1)
+				onStartedLeading()
+			},
+			OnStoppedLeading: func() {
+				//this is also called when we never were the leader, or when we
+				//released the lease on shutdown
+				wasLeading := atomic.SwapInt32(&le.leading, 0) == 1
+				if wasLeading && ctx.Err() == nil {
+					onStoppedLeading()
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election settings: %s", err.Error())
+	}
+	elector.Run(ctx)
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeaderElection(clientset kubernetes.Interface, identity string) *LeaderElection {
+	return &LeaderElection{
+		Clientset:     clientset,
+		Namespace:     "dashboard",
+		LeaseName:     "image-migration-dashboard",
+		Identity:      identity,
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+}
+
+// candidate runs a LeaderElection in the background.
+type candidate struct {
+	Election *LeaderElection
+	Started  chan struct{}
+	Lost     chan struct{}
+	Done     chan struct{}
+	cancel   context.CancelFunc
+}
+
+func startCandidate(t *testing.T, le *LeaderElection) *candidate {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &candidate{le, make(chan struct{}), make(chan struct{}), make(chan struct{}), cancel}
+	go func() {
+		defer close(c.Done)
+		err := le.Run(ctx, func() { close(c.Started) }, func() { close(c.Lost) })
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	return c
+}
+
+func expectClosed(t *testing.T, desc string, ch chan struct{}, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for %s", desc)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	a := startCandidate(t, newTestLeaderElection(clientset, "replica-a"))
+	expectClosed(t, "replica-a to become leader", a.Started, 5*time.Second)
+	assert.DeepEqual(t, "replica-a is leader", a.Election.IsLeader(), true)
+
+	lease, err := clientset.CoordinationV1().Leases("dashboard").Get(context.Background(), "image-migration-dashboard", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "lease holder", *lease.Spec.HolderIdentity, "replica-a")
+
+	//while replica-a renews the lease, replica-b stays a follower
+	b := startCandidate(t, newTestLeaderElection(clientset, "replica-b"))
+	select {
+	case <-b.Started:
+		t.Fatal("replica-b became leader while replica-a holds the lease")
+	case <-time.After(500 * time.Millisecond):
+	}
+	assert.DeepEqual(t, "replica-b is leader", b.Election.IsLeader(), false)
+
+	//on shutdown, replica-a releases the lease without reporting a loss, and
+	//replica-b takes over without waiting for the lease to expire
+	a.cancel()
+	expectClosed(t, "replica-a to stop", a.Done, 5*time.Second)
+	assert.DeepEqual(t, "replica-a is leader", a.Election.IsLeader(), false)
+	select {
+	case <-a.Lost:
+		t.Error("replica-a reported a lost lease on shutdown")
+	default:
+	}
+	expectClosed(t, "replica-b to become leader", b.Started, time.Second)
+	assert.DeepEqual(t, "replica-b is leader", b.Election.IsLeader(), true)
+
+	//when the lease is taken away, replica-b reports the loss
+	lease, err = clientset.CoordinationV1().Leases("dashboard").Get(context.Background(), "image-migration-dashboard", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	holder := "replica-c"
+	lease.Spec.HolderIdentity = &holder
+	_, err = clientset.CoordinationV1().Leases("dashboard").Update(context.Background(), lease, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectClosed(t, "replica-b to lose the lease", b.Lost, 5*time.Second)
+	assert.DeepEqual(t, "replica-b is leader", b.Election.IsLeader(), false)
+	b.cancel()
+	expectClosed(t, "replica-b to stop", b.Done, 5*time.Second)
+}
+
+func TestLeaderElectionInvalidSettings(t *testing.T) {
+	le := newTestLeaderElection(fake.NewSimpleClientset(), "replica-a")
+	le.RenewDeadline = le.LeaseDuration
+	err := le.Run(context.Background(), func() {}, func() {})
+	if err == nil {
+		t.Fatal("expected error for renew deadline equal to lease duration")
+	}
+}
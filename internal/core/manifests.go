@@ -0,0 +1,169 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sapcc/go-bits/logg"
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	batchv2alpha1 "k8s.io/api/batch/v2alpha1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// PodSpecOf returns the pod spec contained in the given object, if any. This
+// covers pods themselves as well as all workload kinds with pod templates.
+func PodSpecOf(obj runtime.Object) (metav1.Object, *corev1.PodSpec) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return o, &o.Spec
+	case *corev1.PodTemplate:
+		return o, &o.Template.Spec
+	case *corev1.ReplicationController:
+		if o.Spec.Template == nil {
+			return nil, nil
+		}
+		return o, &o.Spec.Template.Spec
+	case *appsv1.Deployment:
+		return o, &o.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1.ReplicaSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta1.Deployment:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta1.StatefulSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta2.Deployment:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta2.StatefulSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta2.DaemonSet:
+		return o, &o.Spec.Template.Spec
+	case *appsv1beta2.ReplicaSet:
+		return o, &o.Spec.Template.Spec
+	case *extensionsv1beta1.Deployment:
+		return o, &o.Spec.Template.Spec
+	case *extensionsv1beta1.DaemonSet:
+		return o, &o.Spec.Template.Spec
+	case *extensionsv1beta1.ReplicaSet:
+		return o, &o.Spec.Template.Spec
+	case *batchv1.Job:
+		return o, &o.Spec.Template.Spec
+	case *batchv1beta1.CronJob:
+		return o, &o.Spec.JobTemplate.Spec.Template.Spec
+	case *batchv2alpha1.CronJob:
+		return o, &o.Spec.JobTemplate.Spec.Template.Spec
+	default:
+		return nil, nil
+	}
+}
+
+// ScanManifests walks the given files and directories, and reports the
+// images of all pod specs found in YAML or JSON manifests. The path "-" reads
+// manifests from stdin (e.g. from `helm template`). Objects without a
+// namespace are reported in the given default namespace.
+//
+// Files that cannot be parsed (e.g. Helm templates that have not been
+// rendered) are an error, unless skipInvalid is set, in which case they are
+// skipped with a log message. Objects of kinds that are not known (e.g. custom
+// resources) are always skipped.
+func ScanManifests(paths []string, defaultNamespace string, skipInvalid bool) (ImageReport, error) {
+	allImgs := newImageCollector(newScanCache())
+	var invalid []string
+	for _, path := range paths {
+		if path == "-" {
+			err := allImgs.addManifests(os.Stdin, "<stdin>", defaultNamespace)
+			if err != nil {
+				return ImageReport{}, fmt.Errorf("could not read manifests from stdin: %s", err.Error())
+			}
+			continue
+		}
+
+		root := path
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				//skip hidden directories like .git
+				if path != root && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".yaml", ".yml", ".json":
+			default:
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			err = allImgs.addManifests(f, path, defaultNamespace)
+			switch {
+			case err != nil && skipInvalid:
+				logg.Info("skipping %s: %s", path, err.Error())
+			case err != nil:
+				invalid = append(invalid, fmt.Sprintf("%s: %s", path, err.Error()))
+			}
+			return nil
+		})
+		if err != nil {
+			return ImageReport{}, err
+		}
+	}
+	if len(invalid) > 0 {
+		return ImageReport{}, fmt.Errorf("could not parse %d files:\n%s", len(invalid), strings.Join(invalid, "\n"))
+	}
+
+	return allImgs.report(ImageReport{}, 0), nil
+}
+
+func (ic *imageCollector) addManifests(r io.Reader, path, defaultNamespace string) error {
+	objs, err := DecodeObjects(r)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		meta, spec := PodSpecOf(obj)
+		if spec == nil {
+			continue
+		}
+		ns := meta.GetNamespace()
+		if ns == "" {
+			ns = defaultNamespace
+		}
+		kind := obj.GetObjectKind().GroupVersionKind().Kind
+		ic.addPodSpec(ns, meta.GetName(), *spec, fmt.Sprintf("%s: %s", path, kind))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestScanManifests(t *testing.T) {
+	//testdata/manifests/unrendered.yaml is a Helm template
+	_, err := ScanManifests([]string{"testdata/manifests"}, "default", false)
+	if err == nil {
+		t.Fatal("expected invalid manifest to be reported")
+	}
+	assert.DeepEqual(t, "error", err.Error(), "could not parse 1 files:\n"+
+		"testdata/manifests/unrendered.yaml: yaml: line 6: could not find expected ':'")
+
+	report, err := ScanManifests([]string{"testdata/manifests"}, "default", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	assert.DeepEqual(t, "Quay images", report.Quay, []Image{{
+		Name: "hub.global.cloud.sap/monsoon/backup-tools:20200310",
+		Containers: []Container{{
+			Name:   "monsoon3/db-backup/backup",
+			Source: "testdata/manifests/cronjob.yaml: CronJob",
+		}},
+	}})
+	assert.DeepEqual(t, "Keppel images", report.Keppel, []Image{{
+		Name: "keppel.eu-de-1.cloud.sap/ccloud-dockerhub-mirror/library/rabbitmq:3.7",
+		Containers: []Container{{
+			Name:   "default/rabbitmq/rabbitmq",
+			Source: "testdata/manifests/statefulset.yaml: StatefulSet",
+		}},
+	}})
+	assert.DeepEqual(t, "Docker Hub images", len(report.DockerHub), 0)
+	assert.DeepEqual(t, "Misc images", len(report.Misc), 0)
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newPaginatedClientset returns a fake clientset that serves the given pages
+// of pods. The fake clientset does not pass Limit and Continue to reactors, so
+// the pages are served in order and the continue token only signals whether
+// more pages follow.
+func newPaginatedClientset(pages [][]corev1.Pod) kubernetes.Interface {
+	clientset := fake.NewSimpleClientset()
+	next := 0
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		list := &corev1.PodList{Items: pages[next]}
+		next++
+		if next < len(pages) {
+			list.Continue = strconv.Itoa(next)
+		} else {
+			next = 0
+		}
+		return true, list, nil
+	})
+	return clientset
+}
+
+// generatePods returns the given number of pods, split into pages of
+// podListPageSize, that are spread across 100 namespaces and use a mix of
+// images from all registries.
+func generatePods(count int) [][]corev1.Pod {
+	images := []string{
+		"keppel.eu-de-1.cloud.sap/ccloud/loci-nova:stein-20200401",
+		"keppel.eu-de-1.cloud.sap/ccloud/loci-neutron:stein-20200401",
+		"hub.global.cloud.sap/monsoon/swift-proxy:rocky-20200115",
+		"prom/statsd-exporter:v0.15.0",
+		"quay.io/prometheus/node-exporter:v0.18.1",
+	}
+	var pages [][]corev1.Pod
+	var page []corev1.Pod
+	for idx := 0; idx < count; idx++ {
+		image := images[idx%len(images)]
+		page = append(page, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("pod-%d", idx),
+				Namespace: fmt.Sprintf("namespace-%d", idx%100),
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "main", Image: image},
+					{Name: "statsd", Image: "prom/statsd-exporter:v0.15.0"},
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "main", Image: image, ImageID: "docker-pullable://" + image},
+					{Name: "statsd", Image: "docker.io/prom/statsd-exporter:v0.15.0"},
+				},
+			},
+		})
+		if len(page) == podListPageSize {
+			pages = append(pages, page)
+			page = nil
+		}
+	}
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+func TestScanClusterPaginated(t *testing.T) {
+	pages := generatePods(1200)
+	// a pod that moves between pages while listing is seen twice
+	pages[2] = append(pages[2], pages[0][0])
+	clientset := newPaginatedClientset(pages)
+
+	db := newTestDatabase(t)
+	err := db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	result := db.DailyResults[db.LastScrapeTime.Format(ISODateFormat)]
+	assert.DeepEqual(t, "images", result.NoOfImages.Total, 5)
+	// the duplicate pod is only counted once
+	assert.DeepEqual(t, "pods", result.NoOfPods.Total, 1200)
+	assert.DeepEqual(t, "containers", result.NoOfContainers.Total, 2400)
+	assert.DeepEqual(t, "running containers", result.NoOfRunningContainers.Total, 2400)
+}
+
+// newExpiringClientset returns a fake clientset that serves the given pages
+// in the given order. A negative index answers with an expired continue
+// token.
+func newExpiringClientset(pages [][]corev1.Pod, order ...int) kubernetes.Interface {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		idx := order[0]
+		order = order[1:]
+		if idx < 0 {
+			return true, nil, apierrors.NewResourceExpired("continue token expired")
+		}
+		list := &corev1.PodList{Items: pages[idx]}
+		if idx < len(pages)-1 {
+			list.Continue = strconv.Itoa(idx + 1)
+		}
+		return true, list, nil
+	})
+	return clientset
+}
+
+func TestScanClusterExpiredContinueToken(t *testing.T) {
+	pages := generatePods(1200)
+
+	//the listing starts over, and pods from the first attempt are not counted twice
+	db := newTestDatabase(t)
+	err := db.ScanCluster(context.Background(), newExpiringClientset(pages, 0, 1, -1, 0, 1, 2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result := db.DailyResults[db.LastScrapeTime.Format(ISODateFormat)]
+	assert.DeepEqual(t, "pods", result.NoOfPods.Total, 1200)
+	assert.DeepEqual(t, "containers", result.NoOfContainers.Total, 2400)
+
+	//the scan fails if the token keeps expiring
+	_, err = listPods(context.Background(), newExpiringClientset(pages, 0, -1, 0, -1, 0, -1, 0, -1), func(*corev1.Pod) {})
+	assert.DeepEqual(t, "error", err.Error(), "could not list pods: continue token expired 4 times")
+}
+
+func BenchmarkScanCluster100kPods(b *testing.B) {
+	clientset := newPaginatedClientset(generatePods(100000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db := &Database{
+			DailyResults: make(map[string]ScanResult),
+			Storage:      &MemoryStorage{},
+		}
+		err := db.ScanCluster(context.Background(), clientset)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Policy describes which registries may not be used in which namespaces.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule is a single rule within a Policy.
+type PolicyRule struct {
+	// Description is shown to the user when the rule is violated.
+	Description string `json:"description"`
+	// Action is only used by the admission webhook, and determines whether
+	// violating pods are denied (the default) or only receive a warning.
+	Action PolicyAction `json:"action"`
+	// Registries lists the registries that images may not come from.
+	Registries []Registry `json:"registries"`
+	// Namespaces lists the namespaces that the rule applies to. Shell glob
+	// patterns like "kube-*" are accepted. If empty, the rule applies to all
+	// namespaces.
+	Namespaces []string `json:"namespaces"`
+}
+
+// PolicyAction is the action of a PolicyRule.
+type PolicyAction string
+
+// Acceptable values for PolicyAction.
+const (
+	PolicyActionDeny PolicyAction = "deny"
+	PolicyActionWarn PolicyAction = "warn"
+)
+
+// Violation describes a container that violates a PolicyRule.
+type Violation struct {
+	Image     string   `json:"image"`
+	Registry  Registry `json:"registry"`
+	Container string   `json:"container"`
+	Workload  string   `json:"workload,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Rule      string   `json:"rule"`
+}
+
+// baselineEntry returns the BaselineEntry that grandfathers this violation.
+func (v Violation) baselineEntry() BaselineEntry {
+	return BaselineEntry{
+		Repository: imageRepository(v.Image),
+		Location:   Container{Name: v.Container, Workload: v.Workload}.workloadKey(),
+	}
+}
+
+// imageRepository strips the tag and the digest from an image reference.
+func imageRepository(image string) string {
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		image = image[:idx]
+	}
+	//a colon before the last slash separates the port of the registry
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		image = image[:idx]
+	}
+	return image
+}
+
+// ReadPolicy reads a Policy from the given YAML or JSON file.
+func ReadPolicy(filePath string) (Policy, error) {
+	var p Policy
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return p, err
+	}
+	err = yaml.UnmarshalStrict(b, &p)
+	if err != nil {
+		return p, fmt.Errorf("could not parse policy %s: %s", filePath, err.Error())
+	}
+	return p, p.validate()
+}
+
+func (p Policy) validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("policy does not contain any rules")
+	}
+	for idx, rule := range p.Rules {
+		if len(rule.Registries) == 0 {
+			return fmt.Errorf("rule %d does not list any registries", idx+1)
+		}
+		for _, reg := range rule.Registries {
+			switch reg {
+			case RegistryKeppel, RegistryQuay, RegistryDockerHub, RegistryMisc:
+			default:
+				return fmt.Errorf("rule %d contains unknown registry %q", idx+1, reg)
+			}
+		}
+		switch rule.Action {
+		case "", PolicyActionDeny, PolicyActionWarn:
+		default:
+			return fmt.Errorf("rule %d contains unknown action %q", idx+1, rule.Action)
+		}
+		for _, pattern := range rule.Namespaces {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("rule %d contains invalid namespace pattern %q: %s", idx+1, pattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (r PolicyRule) String() string {
+	if r.Description != "" {
+		return r.Description
+	}
+	return fmt.Sprintf("no images from %v in namespaces %v", r.Registries, r.Namespaces)
+}
+
+// ActionOrDefault returns the rule's action, or PolicyActionDeny if none is
+// set.
+func (r PolicyRule) ActionOrDefault() PolicyAction {
+	if r.Action == "" {
+		return PolicyActionDeny
+	}
+	return r.Action
+}
+
+// MatchRule returns the first rule of this policy that forbids images from the
+// given registry in the given namespace, or nil if there is none.
+func (p Policy) MatchRule(reg Registry, namespace string) *PolicyRule {
+	for idx, rule := range p.Rules {
+		if rule.appliesTo(reg, namespace) {
+			return &p.Rules[idx]
+		}
+	}
+	return nil
+}
+
+func (r PolicyRule) appliesTo(reg Registry, namespace string) bool {
+	found := false
+	for _, rr := range r.Registries {
+		if rr == reg {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	return matchesAnyPattern(namespace, r.Namespaces, true)
+}
+
+// matchesAnyPattern checks whether the given value matches any of the given
+// shell glob patterns. If there are no patterns, emptyResult is returned.
+func matchesAnyPattern(value string, patterns []string, emptyResult bool) bool {
+	if len(patterns) == 0 {
+		return emptyResult
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns all violations of this policy in the given image report,
+// sorted by image and container. Each container is only reported for the
+// first rule that it violates.
+func (p Policy) Check(report ImageReport) []Violation {
+	var result []Violation
+	for _, reg := range AllRegistries {
+		for _, img := range report.Get(reg) {
+			for _, c := range img.Containers {
+				rule := p.MatchRule(reg, c.Namespace())
+				if rule != nil {
+					result = append(result, Violation{
+						Image:     img.Name,
+						Registry:  reg,
+						Container: c.Name,
+						Workload:  c.Workload,
+						Source:    c.Source,
+						Rule:      rule.String(),
+					})
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Image != result[j].Image {
+			return result[i].Image < result[j].Image
+		}
+		return result[i].Container < result[j].Container
+	})
+	return result
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Baseline
+
+// Baseline is a list of known violations that are grandfathered, i.e. do not
+// cause a policy check to fail.
+type Baseline struct {
+	Violations []BaselineEntry `json:"violations"`
+}
+
+// BaselineEntry identifies a single grandfathered violation. It refers to the
+// image repository (without tag or digest) and to the workload instead of the
+// pod (see Container.workloadKey), so that a tag bump or a rollout does not
+// make a grandfathered violation look new.
+type BaselineEntry struct {
+	Repository string `json:"repository"`
+	Location   string `json:"location"`
+}
+
+// ReadBaseline reads a Baseline from the given YAML or JSON file. Baselines
+// from older versions, which list the full image and container name, are
+// converted.
+func ReadBaseline(filePath string) (Baseline, error) {
+	var data struct {
+		Violations []struct {
+			Repository string `json:"repository"`
+			Location   string `json:"location"`
+			Image      string `json:"image"`
+			Container  string `json:"container"`
+		} `json:"violations"`
+	}
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return Baseline{}, err
+	}
+	err = yaml.UnmarshalStrict(buf, &data)
+	if err != nil {
+		return Baseline{}, fmt.Errorf("could not parse baseline %s: %s", filePath, err.Error())
+	}
+
+	b := Baseline{Violations: []BaselineEntry{}}
+	for _, e := range data.Violations {
+		if e.Repository == "" && e.Location == "" {
+			e.Repository, e.Location = imageRepository(e.Image), e.Container
+		}
+		b.Violations = append(b.Violations, BaselineEntry{Repository: e.Repository, Location: e.Location})
+	}
+	return b, nil
+}
+
+// NewBaseline returns a Baseline that grandfathers all of the given
+// violations.
+func NewBaseline(violations []Violation) Baseline {
+	b := Baseline{Violations: []BaselineEntry{}}
+	known := make(map[BaselineEntry]bool, len(violations))
+	for _, v := range violations {
+		e := v.baselineEntry()
+		if !known[e] {
+			known[e] = true
+			b.Violations = append(b.Violations, e)
+		}
+	}
+	return b
+}
+
+// Filter splits the given violations into those that are new and those that
+// are grandfathered by this baseline.
+func (b Baseline) Filter(violations []Violation) (newViolations, knownViolations []Violation) {
+	known := make(map[BaselineEntry]bool, len(b.Violations))
+	for _, e := range b.Violations {
+		known[e] = true
+	}
+	for _, v := range violations {
+		if known[v.baselineEntry()] {
+			knownViolations = append(knownViolations, v)
+		} else {
+			newViolations = append(newViolations, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	var report ImageReport
+	report.Add(RegistryQuay, Image{
+		Name: "hub.global.cloud.sap/monsoon/nova:rocky",
+		Containers: []Container{
+			{Name: "monsoon3/nova-api/nova-api"},
+			{Name: "kube-system/nova-api/nova-api"},
+		},
+	})
+	report.Add(RegistryDockerHub, Image{
+		Name:       "library/nginx:1.17",
+		Containers: []Container{{Name: "kube-ingress/nginx/nginx"}},
+	})
+	report.Add(RegistryKeppel, Image{
+		Name:       "keppel.eu-de-1.cloud.sap/ccloud/nova:stein",
+		Containers: []Container{{Name: "monsoon3/nova-scheduler/nova-scheduler"}},
+	})
+
+	policy := Policy{Rules: []PolicyRule{
+		{Description: "no Quay", Registries: []Registry{RegistryQuay}, Namespaces: []string{"monsoon3"}},
+		{Description: "no Docker Hub", Registries: []Registry{RegistryDockerHub}, Namespaces: []string{"kube-*"}},
+	}}
+	violations := policy.Check(report)
+	assert.DeepEqual(t, "violations", violations, []Violation{
+		{
+			Image:     "hub.global.cloud.sap/monsoon/nova:rocky",
+			Registry:  RegistryQuay,
+			Container: "monsoon3/nova-api/nova-api",
+			Rule:      "no Quay",
+		},
+		{
+			Image:     "library/nginx:1.17",
+			Registry:  RegistryDockerHub,
+			Container: "kube-ingress/nginx/nginx",
+			Rule:      "no Docker Hub",
+		},
+	})
+
+	baseline := Baseline{Violations: []BaselineEntry{
+		{Repository: "library/nginx", Location: "kube-ingress/nginx/nginx"},
+	}}
+	newViolations, knownViolations := baseline.Filter(violations)
+	assert.DeepEqual(t, "new violations", newViolations, violations[:1])
+	assert.DeepEqual(t, "known violations", knownViolations, violations[1:])
+}
+
+func TestBaselineSurvivesTagBumpsAndRollouts(t *testing.T) {
+	violation := func(image, container string) Violation {
+		return Violation{Image: image, Container: container, Workload: "Deployment/nova-api", Rule: "no Quay"}
+	}
+	baseline := NewBaseline([]Violation{
+		violation("hub.global.cloud.sap/monsoon/nova:rocky-20200101", "monsoon3/nova-api-5d8f7c9b4-x2vzq/nova-api"),
+		violation("hub.global.cloud.sap/monsoon/nova:rocky-20200101", "monsoon3/nova-api-5d8f7c9b4-mp7rt/nova-api"),
+	})
+	assert.DeepEqual(t, "baseline", baseline, Baseline{Violations: []BaselineEntry{
+		{Repository: "hub.global.cloud.sap/monsoon/nova", Location: "monsoon3/Deployment/nova-api/nova-api"},
+	}})
+
+	violations := []Violation{
+		violation("hub.global.cloud.sap/monsoon/nova:rocky-20200301", "monsoon3/nova-api-6c4b8d7f9-hz8sd/nova-api"),
+		violation("hub.global.cloud.sap/monsoon/nova-tools:rocky", "monsoon3/nova-api-6c4b8d7f9-hz8sd/tools"),
+	}
+	newViolations, knownViolations := baseline.Filter(violations)
+	assert.DeepEqual(t, "new violations", newViolations, violations[1:])
+	assert.DeepEqual(t, "known violations", knownViolations, violations[:1])
+}
+
+func TestImageRepository(t *testing.T) {
+	testCases := map[string]string{
+		"library/nginx":                        "library/nginx",
+		"library/nginx:1.17":                   "library/nginx",
+		"registry.example.com:5000/app":        "registry.example.com:5000/app",
+		"registry.example.com:5000/app:v1":     "registry.example.com:5000/app",
+		"keppel.example.com/app:v1@sha256:abc": "keppel.example.com/app",
+	}
+	for image, expected := range testCases {
+		assert.DeepEqual(t, "repository of "+image, imageRepository(image), expected)
+	}
+}
+
+func TestReadLegacyBaseline(t *testing.T) {
+	baseline, err := ReadBaseline("testdata/legacy-baseline.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "baseline", baseline, Baseline{Violations: []BaselineEntry{
+		{Repository: "library/nginx", Location: "kube-ingress/nginx/nginx"},
+	}})
+}
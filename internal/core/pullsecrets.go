@@ -0,0 +1,223 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/go-bits/logg"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PullSecret holds the data for an image pull secret that contains
+// credentials for deprecated registries (i.e. Quay or Docker Hub).
+type PullSecret struct {
+	// Secret names are in the form: namespace/secret
+	Name string `json:"name"`
+	// Hostnames of the deprecated registries in this secret. The credentials
+	// themselves are never stored.
+	Registries []string `json:"registries"`
+	// Workloads whose pods refer to this secret directly, in the form
+	// namespace/kind/name (e.g. "monsoon3/Deployment/keystone-api"). Pods
+	// without a controller are listed as namespace/Pod/name.
+	Workloads []string `json:"workloads"`
+	// Service account names are in the form: namespace/serviceaccount
+	ServiceAccounts []string `json:"service_accounts"`
+}
+
+// dockerHubHosts are the hostnames that Docker Hub credentials are stored
+// under in dockerconfig files.
+var dockerHubHosts = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// ClassifyRegistryHost determines which registry the given hostname (as found
+// in the "auths" section of a dockerconfig file) belongs to.
+func ClassifyRegistryHost(host string) Registry {
+	if dockerHubHosts[host] {
+		return RegistryDockerHub
+	}
+	//use a dummy image name to reuse the image classification
+	reg := ClassifyImage(host + "/image")
+	if reg == RegistryDockerHub {
+		//hostnames without dots (e.g. "localhost") are not Docker Hub
+		return RegistryMisc
+	}
+	return reg
+}
+
+// registryHostsInSecret returns the normalized hostnames of all registries that
+// an image pull secret contains credentials for.
+func registryHostsInSecret(secret *corev1.Secret) ([]string, error) {
+	var auths map[string]json.RawMessage
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var data struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}
+		err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &data)
+		if err != nil {
+			return nil, err
+		}
+		auths = data.Auths
+	case corev1.SecretTypeDockercfg:
+		err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected secret type %q", secret.Type)
+	}
+
+	var result []string
+	for key := range auths {
+		//keys can be URLs like "https://index.docker.io/v1/"
+		host := key
+		if idx := strings.Index(host, "://"); idx >= 0 {
+			host = host[idx+3:]
+		}
+		host = strings.SplitN(host, "/", 2)[0]
+		result = append(result, strings.ToLower(host))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// pullSecretCollector collects the image pull secrets that are used by pods,
+// either directly or through their service account.
+type pullSecretCollector struct {
+	clientset kubernetes.Interface
+	// set of "namespace/serviceaccount" that were already inspected
+	serviceAccounts map[string]bool
+	// maps "namespace/secret" to the secret's usage
+	secrets map[string]*PullSecret
+	// set of "namespace/secret/workload" that were already recorded
+	workloads map[string]bool
+	// errors are only logged once per scan to avoid flooding the log
+	failed bool
+}
+
+func newPullSecretCollector(clientset kubernetes.Interface) *pullSecretCollector {
+	return &pullSecretCollector{
+		clientset:       clientset,
+		serviceAccounts: make(map[string]bool),
+		secrets:         make(map[string]*PullSecret),
+		workloads:       make(map[string]bool),
+	}
+}
+
+func (pc *pullSecretCollector) logError(msg string, args ...interface{}) {
+	if !pc.failed {
+		logg.Error("pull secret audit incomplete: "+msg, args...)
+		pc.failed = true
+	}
+}
+
+func (pc *pullSecretCollector) secret(namespace, name string) *PullSecret {
+	n := namespace + "/" + name
+	s, exists := pc.secrets[n]
+	if !exists {
+		s = &PullSecret{Name: n}
+		pc.secrets[n] = s
+	}
+	return s
+}
+
+// addPod records the pull secrets of the given pod and of its service account.
+func (pc *pullSecretCollector) addPod(ctx context.Context, pod *corev1.Pod) {
+	//all pods of a workload refer to the same secrets, so they are only listed once
+	workload := "Pod/" + pod.Name
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		workload = workloadOf(owner.Kind + "/" + owner.Name)
+	}
+	workload = pod.Namespace + "/" + workload
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		key := pod.Namespace + "/" + ref.Name + "/" + workload
+		if pc.workloads[key] {
+			continue
+		}
+		pc.workloads[key] = true
+		s := pc.secret(pod.Namespace, ref.Name)
+		s.Workloads = append(s.Workloads, workload)
+	}
+
+	saName := pod.Spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+	n := pod.Namespace + "/" + saName
+	if pc.serviceAccounts[n] {
+		return
+	}
+	pc.serviceAccounts[n] = true
+	sa, err := pc.clientset.CoreV1().ServiceAccounts(pod.Namespace).Get(ctx, saName, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			pc.logError("could not get service account %s: %s", n, err.Error())
+		}
+		return
+	}
+	for _, ref := range sa.ImagePullSecrets {
+		s := pc.secret(pod.Namespace, ref.Name)
+		s.ServiceAccounts = append(s.ServiceAccounts, n)
+	}
+}
+
+// report reads all collected secrets and returns those that contain
+// credentials for deprecated registries, sorted by name.
+func (pc *pullSecretCollector) report(ctx context.Context) []PullSecret {
+	var result []PullSecret
+	for n, s := range pc.secrets {
+		fields := strings.SplitN(n, "/", 2)
+		secret, err := pc.clientset.CoreV1().Secrets(fields[0]).Get(ctx, fields[1], metav1.GetOptions{})
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				pc.logError("could not get secret %s: %s", n, err.Error())
+			}
+			continue
+		}
+		hosts, err := registryHostsInSecret(secret)
+		if err != nil {
+			logg.Info("skipping image pull secret %s: %s", n, err.Error())
+			continue
+		}
+		for _, host := range hosts {
+			switch ClassifyRegistryHost(host) {
+			case RegistryQuay, RegistryDockerHub:
+				s.Registries = append(s.Registries, host)
+			}
+		}
+		if len(s.Registries) > 0 {
+			sort.Strings(s.Workloads)
+			sort.Strings(s.ServiceAccounts)
+			result = append(result, *s)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
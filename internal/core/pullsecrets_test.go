@@ -0,0 +1,154 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClassifyRegistryHost(t *testing.T) {
+	testCases := map[string]Registry{
+		"hub.global.cloud.sap":       RegistryQuay,
+		"keppel.eu-de-1.cloud.sap":   RegistryKeppel,
+		"docker.io":                  RegistryDockerHub,
+		"index.docker.io":            RegistryDockerHub,
+		"registry-1.docker.io":       RegistryDockerHub,
+		"registry.hub.docker.com":    RegistryDockerHub,
+		"localhost":                  RegistryMisc,
+		"localhost:5000":             RegistryMisc,
+		"registry.example.com:5000":  RegistryMisc,
+		"hub.global.cloud.sap:443":   RegistryQuay,
+		"docker.io.example.com:5000": RegistryMisc,
+	}
+	for host, expected := range testCases {
+		assert.DeepEqual(t, "registry of "+host, ClassifyRegistryHost(host), expected)
+	}
+}
+
+func TestRegistryHostsInSecret(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Type        corev1.SecretType
+		Data        map[string]string
+		Hosts       []string
+		Error       string
+	}{
+		{
+			Description: ".dockerconfigjson",
+			Type:        corev1.SecretTypeDockerConfigJson,
+			Data: map[string]string{corev1.DockerConfigJsonKey: `{"auths":{` +
+				`"hub.global.cloud.sap":{"auth":"ZHVtbXk6ZHVtbXk="},` +
+				`"Keppel.eu-de-1.cloud.sap:443":{"auth":"ZHVtbXk6ZHVtbXk="}}}`},
+			Hosts: []string{"hub.global.cloud.sap", "keppel.eu-de-1.cloud.sap:443"},
+		},
+		{
+			Description: ".dockercfg with URLs",
+			Type:        corev1.SecretTypeDockercfg,
+			Data: map[string]string{corev1.DockerConfigKey: `{` +
+				`"https://index.docker.io/v1/":{"auth":"ZHVtbXk6ZHVtbXk="},` +
+				`"http://localhost:5000":{"auth":"ZHVtbXk6ZHVtbXk="}}`},
+			Hosts: []string{"index.docker.io", "localhost:5000"},
+		},
+		{
+			Description: ".dockercfg in a .dockerconfigjson secret",
+			Type:        corev1.SecretTypeDockerConfigJson,
+			Data:        map[string]string{corev1.DockerConfigJsonKey: `{"hub.global.cloud.sap":{"auth":"ZHVtbXk6ZHVtbXk="}}`},
+			Hosts:       nil,
+		},
+		{
+			Description: "malformed .dockerconfigjson",
+			Type:        corev1.SecretTypeDockerConfigJson,
+			Data:        map[string]string{corev1.DockerConfigJsonKey: `{"auths":`},
+			Error:       "unexpected end of JSON input",
+		},
+		{
+			Description: "missing .dockercfg",
+			Type:        corev1.SecretTypeDockercfg,
+			Data:        map[string]string{},
+			Error:       "unexpected end of JSON input",
+		},
+		{
+			Description: "opaque secret",
+			Type:        corev1.SecretTypeOpaque,
+			Data:        map[string]string{"password": "dummy"},
+			Error:       `unexpected secret type "Opaque"`,
+		},
+	}
+	for _, tc := range testCases {
+		secret := &corev1.Secret{Type: tc.Type, Data: make(map[string][]byte)}
+		for k, v := range tc.Data {
+			secret.Data[k] = []byte(v)
+		}
+		hosts, err := registryHostsInSecret(secret)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		assert.DeepEqual(t, tc.Description+": error", errMsg, tc.Error)
+		assert.DeepEqual(t, tc.Description+": hosts", hosts, tc.Hosts)
+	}
+}
+
+func TestPullSecretsGroupedByWorkload(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "quay-pull", Namespace: "monsoon3"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"hub.global.cloud.sap":{"auth":"ZHVtbXk6ZHVtbXk="}}}`),
+		},
+	}
+	pod := func(name, ownerKind, ownerName string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "monsoon3"},
+			Spec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "quay-pull"}},
+			},
+		}
+		if ownerKind != "" {
+			isController := true
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: ownerKind, Name: ownerName, Controller: &isController}}
+		}
+		return p
+	}
+
+	ctx := context.Background()
+	pc := newPullSecretCollector(fake.NewSimpleClientset(secret))
+	for _, p := range []*corev1.Pod{
+		pod("api-5d8f7c9b4-x2vzq", "ReplicaSet", "api-5d8f7c9b4"),
+		pod("api-5d8f7c9b4-k4wqn", "ReplicaSet", "api-5d8f7c9b4"),
+		pod("api-6c4b8d7f9-mp7rt", "ReplicaSet", "api-6c4b8d7f9"),
+		pod("backup-1590969600-hz8sd", "Job", "backup-1590969600"),
+		pod("postgres-0", "StatefulSet", "postgres"),
+		pod("debug", "", ""),
+	} {
+		pc.addPod(ctx, p)
+	}
+	assert.DeepEqual(t, "pull secrets", pc.report(ctx), []PullSecret{{
+		Name:       "monsoon3/quay-pull",
+		Registries: []string{"hub.global.cloud.sap"},
+		Workloads: []string{
+			"monsoon3/CronJob/backup",
+			"monsoon3/Deployment/api",
+			"monsoon3/Pod/debug",
+			"monsoon3/StatefulSet/postgres",
+		},
+	}})
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RawScan is the data from a cluster scan before the images are classified.
+// It is persisted along with each scan, so that the ScanResult and the
+// ImageReport can be rebuilt with Reclassify when the classification rules
+// change.
+type RawScan struct {
+	ScrapedAt          int64              `json:"scraped_at"` // UTC
+	TerminatedPods     TerminatedPodsMode `json:"terminated_pods"`
+	NoOfTerminatedPods int                `json:"no_of_terminated_pods"`
+	Exclusions         []Exclusion        `json:"exclusions,omitempty"`
+	Containers         []RawContainer     `json:"containers"`
+	// Pull secrets cannot be reclassified, since only the hostnames of the
+	// deprecated registries are known. They are kept as found by the scan.
+	PullSecrets []PullSecret `json:"pull_secrets,omitempty"`
+}
+
+// Acceptable values for RawContainer.Kind.
+const (
+	// Regular and init containers have an empty Kind.
+	RawContainerEphemeral = "ephemeral"
+	// Containers of pods in terminal phases that are reported separately.
+	RawContainerTerminated = "terminated"
+)
+
+// RawContainer is a container found by a cluster scan.
+type RawContainer struct {
+	// Container names are in the form: namespace/pod/container
+	Name string `json:"name"`
+	// The image from the pod spec.
+	Image string `json:"image"`
+	// The controller of the pod, e.g. "ReplicaSet/keystone-api-5d8f7c9b4".
+	Owner string `json:"owner,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	// Only set if the pod status reports the container.
+	StatusImage string `json:"status_image,omitempty"`
+	ImageID     string `json:"image_id,omitempty"`
+}
+
+// Pod template hashes only contain these characters (see
+// k8s.io/apimachinery/pkg/util/rand.SafeEncodeString).
+var podTemplateHashRx = regexp.MustCompile(`^[bcdfghjklmnpqrstvwxz2456789]+$`)
+
+// workloadOf returns the workload that a pod controller belongs to, i.e. the
+// Deployment for a ReplicaSet created by one (e.g. "ReplicaSet/app-5d8f7c9b4"
+// becomes "Deployment/app"), and the CronJob for a Job created by one.
+// Other controllers are returned unchanged.
+func workloadOf(owner string) string {
+	fields := strings.SplitN(owner, "/", 2)
+	if len(fields) != 2 {
+		return owner
+	}
+	idx := strings.LastIndex(fields[1], "-")
+	if idx < 0 {
+		return owner
+	}
+	name, suffix := fields[1][:idx], fields[1][idx+1:]
+	switch {
+	case fields[0] == "ReplicaSet" && podTemplateHashRx.MatchString(suffix):
+		return "Deployment/" + name
+	case fields[0] == "Job" && strings.Trim(suffix, "0123456789") == "":
+		return "CronJob/" + name
+	}
+	return owner
+}
+
+// pod returns the "namespace/pod" part of the container name.
+func (c RawContainer) pod() string {
+	return c.Name[:strings.LastIndex(c.Name, "/")]
+}
+
+// rawCollector records the containers of the pods found by a cluster scan.
+type rawCollector struct {
+	containers []RawContainer
+	cache      *scanCache
+}
+
+// addPod records all regular containers and init containers of the given
+// pod, including the images that are reported as running in the pod status.
+func (rc *rawCollector) addPod(pod *corev1.Pod, kind string) {
+	statuses := make(map[string]corev1.ContainerStatus)
+	for _, cs := range pod.Status.InitContainerStatuses {
+		statuses[cs.Name] = cs
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		statuses[cs.Name] = cs
+	}
+	for _, c := range pod.Spec.Containers {
+		rc.addContainer(pod, c.Name, c.Image, kind, statuses)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		rc.addContainer(pod, c.Name, c.Image, kind, statuses)
+	}
+}
+
+// addEphemeralContainers records all ephemeral containers (as created by
+// `kubectl debug`) of the given pod.
+func (rc *rawCollector) addEphemeralContainers(pod *corev1.Pod, kind string) {
+	statuses := make(map[string]corev1.ContainerStatus)
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		statuses[cs.Name] = cs
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		rc.addContainer(pod, c.Name, c.Image, kind, statuses)
+	}
+}
+
+func (rc *rawCollector) addContainer(pod *corev1.Pod, name, image, kind string, statuses map[string]corev1.ContainerStatus) {
+	c := RawContainer{
+		Name:  pod.Namespace + "/" + pod.Name + "/" + name,
+		Image: rc.cache.intern(image),
+		Kind:  kind,
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		c.Owner = rc.cache.intern(owner.Kind + "/" + owner.Name)
+	}
+	if cs, exists := statuses[name]; exists && cs.Image != "" {
+		c.StatusImage = rc.cache.intern(cs.Image)
+		c.ImageID = rc.cache.intern(cs.ImageID)
+	}
+	rc.containers = append(rc.containers, c)
+}
+
+// classify builds the ScanResult and the ImageReport for this scan using the
+// current classification rules. First-seen timestamps are carried over from
+// the images and containers in the previous report.
+func (raw RawScan) classify(prev ImageReport) (ScanResult, ImageReport) {
+	result := ScanResult{
+		ScrapedAt:          raw.ScrapedAt,
+		NoOfTerminatedPods: raw.NoOfTerminatedPods,
+		TerminatedPods:     raw.TerminatedPods,
+		Exclusions:         raw.Exclusions,
+	}
+	cache := newScanCache()
+	allImgs := newImageCollector(cache)
+	ephemeralImgs := newImageCollector(cache)
+	terminatedImgs := newImageCollector(cache)
+	// a pod is counted once for every registry that its regular and init
+	// containers use images from; the containers of each pod are adjacent
+	var (
+		currentPod    string
+		podRegistries map[Registry]bool
+	)
+	countPod := func() {
+		for reg := range podRegistries {
+			result.NoOfPods.Add(reg, 1)
+		}
+		if podRegistries != nil {
+			result.NoOfPods.Total++
+		}
+	}
+	for _, c := range raw.Containers {
+		switch c.Kind {
+		case RawContainerEphemeral:
+			ephemeralImgs.addRawContainer(c)
+			result.NoOfEphemeralContainers++
+		case RawContainerTerminated:
+			terminatedImgs.addRawContainer(c)
+		default:
+			allImgs.addRawContainer(c)
+			if pod := c.pod(); podRegistries == nil || pod != currentPod {
+				countPod()
+				currentPod = pod
+				podRegistries = make(map[Registry]bool)
+			}
+			podRegistries[cache.classify(c.Image)] = true
+		}
+	}
+	countPod()
+
+	// determine image registry and sort the data alphabetically
+	images := allImgs.report(prev, raw.ScrapedAt)
+	images.Ephemeral = ephemeralImgs.images(prev.Ephemeral, raw.ScrapedAt)
+	images.Terminated = terminatedImgs.images(prev.Terminated, raw.ScrapedAt)
+	images.PullSecrets = raw.PullSecrets
+	result.CountImages(images)
+	return result, images
+}
+
+// Reclassify rebuilds the ScanResult and the ImageReport of each scan in the
+// given storage that has raw data, using the current classification rules,
+// and calls the given function for each rebuilt scan, oldest first. Scans
+// without raw data (from older versions) are skipped.
+//
+// First-seen timestamps are carried over from one rebuilt scan to the next.
+// For the oldest rebuilt scan, they are taken from the given image report
+// (usually the latest persisted one), where they are not newer than the scan.
+func Reclassify(storage Storage, prev ImageReport, fn func(RawScan, ScanResult, ImageReport) error) error {
+	return storage.ForeachRawScan(func(raw RawScan) error {
+		result, images := raw.classify(prev)
+		prev = images
+		return fn(raw, result, images)
+	})
+}
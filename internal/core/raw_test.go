@@ -0,0 +1,225 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestReclassify(t *testing.T) {
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	ctx := context.Background()
+
+	day1 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC).Unix()
+	day2 := time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC).Unix()
+	raw1 := RawScan{
+		ScrapedAt:      day1,
+		TerminatedPods: TerminatedPodsSeparate,
+		Containers: []RawContainer{
+			{Name: "monsoon3/app-1/app", Image: "hub.global.cloud.sap/monsoon/app:1", Owner: "ReplicaSet/app-5d8f7c9b4"},
+			{Name: "monsoon3/app-1/sidecar", Image: "keppel.eu-de-1.cloud.sap/ccloud/sidecar:1", Owner: "ReplicaSet/app-5d8f7c9b4"},
+		},
+	}
+	raw2 := RawScan{
+		ScrapedAt:          day2,
+		TerminatedPods:     TerminatedPodsSeparate,
+		NoOfTerminatedPods: 1,
+		Containers: []RawContainer{
+			{Name: "monsoon3/app-2/app", Image: "hub.global.cloud.sap/monsoon/app:1",
+				StatusImage: "keppel.eu-de-1.cloud.sap/ccloud/app:1", ImageID: "sha256:abc"},
+			{Name: "monsoon3/app-2/debugger", Image: "busybox", Kind: RawContainerEphemeral},
+			{Name: "monsoon3/job-1/job", Image: "hub.global.cloud.sap/monsoon/job:1", Kind: RawContainerTerminated},
+		},
+	}
+	//simulate a history that was classified with outdated rules
+	for _, raw := range []RawScan{raw1, raw2} {
+		err := storage.Save(ctx, ScanResult{ScrapedAt: raw.ScrapedAt, NoOfImages: Counts{Total: 1, Misc: 1}}, &ImageReport{}, &raw)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assert.DeepEqual(t, "objects", backend.objectNames(), []string{
+		"test/image_data/1591012800",
+		"test/image_data/1591099200",
+		"test/raw-data/2020-06-01",
+		"test/raw-data/2020-06-02",
+		"test/scan-result/2020-06-01",
+		"test/scan-result/2020-06-02",
+	})
+
+	var rebuilt []int64
+	err := Reclassify(storage, ImageReport{}, func(raw RawScan, result ScanResult, images ImageReport) error {
+		rebuilt = append(rebuilt, raw.ScrapedAt)
+		return storage.Save(ctx, result, &images, &raw)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "rebuilt scans", rebuilt, []int64{day1, day2})
+
+	db := newTestDatabase(t)
+	err = storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "result for day 1", db.DailyResults["2020-06-01"], ScanResult{
+		ScrapedAt:             day1,
+		NoOfImages:            Counts{Total: 2, Keppel: 1, Quay: 1},
+		NoOfContainers:        Counts{Total: 2, Keppel: 1, Quay: 1},
+		NoOfPods:              Counts{Total: 1, Keppel: 1, Quay: 1},
+		NoOfRunningContainers: Counts{Total: 2, Keppel: 1, Quay: 1},
+		TerminatedPods:        TerminatedPodsSeparate,
+	})
+	assert.DeepEqual(t, "result for day 2", db.DailyResults["2020-06-02"], ScanResult{
+		ScrapedAt:      day2,
+		NoOfImages:     Counts{Total: 1, Quay: 1},
+		NoOfContainers: Counts{Total: 1, Quay: 1},
+		NoOfPods:       Counts{Total: 1, Quay: 1},
+		//the container runs an image from Keppel, even though its spec refers to Quay
+		NoOfRunningContainers:    Counts{Total: 1, Keppel: 1},
+		NoOfMismatchedContainers: 1,
+		NoOfEphemeralContainers:  1,
+		NoOfTerminatedPods:       1,
+		TerminatedPods:           TerminatedPodsSeparate,
+	})
+
+	//first-seen timestamps are carried over between the rebuilt scans, and
+	//locations that are gone on day 2 are listed as removed
+	assert.DeepEqual(t, "images for day 2", db.Images, ImageReport{
+		Quay: []Image{{
+			Name: "hub.global.cloud.sap/monsoon/app:1", FirstSeen: day1, LastSeen: day2,
+			Containers: []Container{{
+				Name: "monsoon3/app-2/app", FirstSeen: day2, LastSeen: day2,
+				StatusImage: "keppel.eu-de-1.cloud.sap/ccloud/app:1", ImageID: "sha256:abc",
+				StatusRegistry: RegistryKeppel, Mismatch: "spec refers to Quay, but image was pulled from Keppel",
+			}},
+		}},
+		Ephemeral: []Image{{
+			Name: "busybox", FirstSeen: day2, LastSeen: day2,
+			Containers: []Container{{Name: "monsoon3/app-2/debugger", FirstSeen: day2, LastSeen: day2}},
+		}},
+		Terminated: []Image{{
+			Name: "hub.global.cloud.sap/monsoon/job:1", FirstSeen: day2, LastSeen: day2,
+			Containers: []Container{{Name: "monsoon3/job-1/job", FirstSeen: day2, LastSeen: day2}},
+		}},
+		Removed: []Image{
+			{
+				Name: "hub.global.cloud.sap/monsoon/app:1", FirstSeen: day1, LastSeen: day1,
+				Containers: []Container{{Name: "monsoon3/app-1/app", Workload: "Deployment/app", FirstSeen: day1, LastSeen: day1}},
+			},
+			{
+				Name: "keppel.eu-de-1.cloud.sap/ccloud/sidecar:1", FirstSeen: day1, LastSeen: day1,
+				Containers: []Container{{Name: "monsoon3/app-1/sidecar", Workload: "Deployment/app", FirstSeen: day1, LastSeen: day1}},
+			},
+		},
+	})
+}
+
+func TestClassifyKeepsFirstSeenAcrossRollouts(t *testing.T) {
+	day1 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC).Unix()
+	day2 := time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC).Unix()
+	image := "keppel.eu-de-1.cloud.sap/ccloud/app:1"
+	raw1 := RawScan{ScrapedAt: day1, Containers: []RawContainer{
+		{Name: "monsoon3/app-5d8f7c9b4-x2vzq/app", Image: image, Owner: "ReplicaSet/app-5d8f7c9b4"},
+		{Name: "monsoon3/backup-1590969600-k4wqn/backup", Image: image, Owner: "Job/backup-1590969600"},
+	}}
+	//after a rollout, the pods and their controllers have new names
+	raw2 := RawScan{ScrapedAt: day2, Containers: []RawContainer{
+		{Name: "monsoon3/app-6c4b8d7f9-mp7rt/app", Image: image, Owner: "ReplicaSet/app-6c4b8d7f9"},
+		{Name: "monsoon3/backup-1591056000-hz8sd/backup", Image: image, Owner: "Job/backup-1591056000"},
+		{Name: "monsoon3/standalone/app", Image: image},
+	}}
+
+	_, images1 := raw1.classify(ImageReport{})
+	_, images2 := raw2.classify(images1)
+	assert.DeepEqual(t, "images", images2.Keppel, []Image{{
+		Name: image, FirstSeen: day1, LastSeen: day2,
+		Containers: []Container{
+			{Name: "monsoon3/app-6c4b8d7f9-mp7rt/app", Workload: "Deployment/app", FirstSeen: day1, LastSeen: day2},
+			{Name: "monsoon3/backup-1591056000-hz8sd/backup", Workload: "CronJob/backup", FirstSeen: day1, LastSeen: day2},
+			{Name: "monsoon3/standalone/app", FirstSeen: day2, LastSeen: day2},
+		},
+	}})
+	//the old pods belong to workloads that are still there, so they are not
+	//listed as removed
+	assert.DeepEqual(t, "removed images", images2.Removed, []Image(nil))
+}
+
+func TestClassifyTracksLastSeen(t *testing.T) {
+	day := func(d int) int64 { return time.Date(2020, 6, d, 12, 0, 0, 0, time.UTC).Unix() }
+	app1 := "keppel.eu-de-1.cloud.sap/ccloud/app:1"
+	app2 := "keppel.eu-de-1.cloud.sap/ccloud/app:2"
+	scan := func(d int, containers ...RawContainer) RawScan {
+		return RawScan{ScrapedAt: day(d), Containers: containers}
+	}
+	api := func(image, pod string) RawContainer {
+		return RawContainer{Name: "monsoon3/" + pod + "/api", Image: image, Owner: "ReplicaSet/api-" + pod[4:]}
+	}
+	worker := RawContainer{Name: "monsoon3/worker/worker", Image: app1}
+
+	//day 1: app:1 is used by the API and the worker; day 2: the API is
+	//updated to app:2
+	_, images1 := scan(1, api(app1, "api-5d8f7c9b4"), worker).classify(ImageReport{})
+	_, images2 := scan(2, api(app2, "api-6c4b8d7f9"), worker).classify(images1)
+	assert.DeepEqual(t, "images on day 2", images2.Keppel, []Image{
+		{Name: app1, FirstSeen: day(1), LastSeen: day(2), Containers: []Container{
+			{Name: "monsoon3/worker/worker", FirstSeen: day(1), LastSeen: day(2)},
+		}},
+		{Name: app2, FirstSeen: day(2), LastSeen: day(2), Containers: []Container{
+			{Name: "monsoon3/api-6c4b8d7f9/api", Workload: "Deployment/api", FirstSeen: day(2), LastSeen: day(2)},
+		}},
+	})
+	removedAPI := Image{Name: app1, FirstSeen: day(1), LastSeen: day(1), Containers: []Container{
+		{Name: "monsoon3/api-5d8f7c9b4/api", Workload: "Deployment/api", FirstSeen: day(1), LastSeen: day(1)},
+	}}
+	assert.DeepEqual(t, "removed on day 2", images2.Removed, []Image{removedAPI})
+
+	//day 3: the worker is gone as well; removed locations keep their
+	//timestamps
+	_, images3 := scan(3, api(app2, "api-6c4b8d7f9")).classify(images2)
+	assert.DeepEqual(t, "removed on day 3", images3.Removed, []Image{{
+		Name: app1, FirstSeen: day(1), LastSeen: day(2), Containers: []Container{
+			{Name: "monsoon3/api-5d8f7c9b4/api", Workload: "Deployment/api", FirstSeen: day(1), LastSeen: day(1)},
+			{Name: "monsoon3/worker/worker", FirstSeen: day(1), LastSeen: day(2)},
+		},
+	}})
+
+	//a location that comes back is no longer listed as removed
+	_, images4 := scan(4, api(app2, "api-6c4b8d7f9"), worker).classify(images3)
+	assert.DeepEqual(t, "removed on day 4", images4.Removed, []Image{removedAPI})
+
+	//removed locations are dropped after removedRetention
+	_, images9 := scan(9, api(app2, "api-6c4b8d7f9"), worker).classify(images4)
+	assert.DeepEqual(t, "removed on day 9", images9.Removed, []Image(nil))
+}
+
+func TestWorkloadOf(t *testing.T) {
+	testCases := map[string]string{
+		"ReplicaSet/keystone-api-5d8f7c9b4": "Deployment/keystone-api",
+		"ReplicaSet/keystone-api":           "ReplicaSet/keystone-api",
+		"Job/backup-1590969600":             "CronJob/backup",
+		"Job/db-migration":                  "Job/db-migration",
+		"StatefulSet/postgres":              "StatefulSet/postgres",
+		"":                                  "",
+	}
+	for owner, expected := range testCases {
+		assert.DeepEqual(t, "workload of "+owner, workloadOf(owner), expected)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Scanner runs cluster scans in the background, one at a time. Requests for a
+// scan while another scan is running are coalesced into the running scan.
+type Scanner struct {
+	ctx       context.Context
+	db        *Database
+	clientset kubernetes.Interface
+	mutex     sync.Mutex
+	status    ScanStatus
+	// closed when the running scan is finished
+	done chan struct{}
+}
+
+// ScanStatus describes the running or most recent scan of a Scanner.
+type ScanStatus struct {
+	Running bool `json:"running"`
+	// What caused the scan, e.g. "schedule" or "api".
+	Trigger    string `json:"trigger,omitempty"`
+	StartedAt  int64  `json:"started_at,omitempty"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	// While the scan is running, this is the number of pods seen so far by the
+	// current attempt.
+	PodsSeen int    `json:"pods_seen"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewScanner creates a Scanner for the given database. When the given context
+// expires, no new scans are started, and a running scan is cancelled after
+// the database's ShutdownGracePeriod.
+func NewScanner(ctx context.Context, db *Database, clientset kubernetes.Interface) *Scanner {
+	done := make(chan struct{})
+	close(done)
+	return &Scanner{ctx: ctx, db: db, clientset: clientset, done: done}
+}
+
+// Trigger starts a scan in the background, unless a scan is already running
+// or the Scanner's context has expired.
+// Returns the status of the new or running scan, and whether a new scan was
+// started.
+func (s *Scanner) Trigger(trigger string) (ScanStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.status.Running || s.ctx.Err() != nil {
+		return s.currentStatus(), false
+	}
+
+	s.status = ScanStatus{
+		Running:   true,
+		Trigger:   trigger,
+		StartedAt: time.Now().Unix(),
+	}
+	s.done = make(chan struct{})
+	go s.run(s.done)
+	return s.status, true
+}
+
+func (s *Scanner) run(done chan struct{}) {
+	defer close(done)
+	s.db.RW.RLock()
+	attemptsBefore := s.db.scanAttemptCount
+	s.db.RW.RUnlock()
+
+	err := s.db.ScanCluster(s.ctx, s.clientset)
+	if err != nil {
+		logg.Error("cluster scan unsuccessful: %s", err.Error())
+	}
+
+	s.db.RW.RLock()
+	attempts := s.db.scanAttemptCount - attemptsBefore
+	var podsSeen int
+	if n := len(s.db.ScanAttempts); n > 0 {
+		podsSeen = s.db.ScanAttempts[n-1].PodsSeen
+	}
+	s.db.RW.RUnlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Running = false
+	s.status.FinishedAt = time.Now().Unix()
+	s.status.PodsSeen = podsSeen
+	s.status.Attempts = attempts
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+}
+
+// Wait blocks until the running scan (if any) is finished.
+func (s *Scanner) Wait() {
+	s.mutex.Lock()
+	done := s.done
+	s.mutex.Unlock()
+	<-done
+}
+
+// Status returns the status of the running or most recent scan.
+func (s *Scanner) Status() ScanStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.currentStatus()
+}
+
+// currentStatus adds the progress of a running scan to the status. The
+// caller must hold the mutex.
+func (s *Scanner) currentStatus() ScanStatus {
+	status := s.status
+	if status.Running {
+		status.PodsSeen = int(atomic.LoadInt64(&s.db.podsSeen))
+	}
+	return status
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestScannerCoalescesTriggers(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// block the scan until the test has triggered it a second time
+	release := make(chan struct{})
+	listCalls := 0
+	clientset.(*fake.Clientset).PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listCalls++
+		<-release
+		return false, nil, nil
+	})
+
+	db := newTestDatabase(t)
+	scanner := NewScanner(context.Background(), db, clientset)
+	status, started := scanner.Trigger("api")
+	assert.DeepEqual(t, "first trigger started", started, true)
+	assert.DeepEqual(t, "running", status.Running, true)
+
+	status, started = scanner.Trigger("api")
+	assert.DeepEqual(t, "second trigger started", started, false)
+	assert.DeepEqual(t, "running", status.Running, true)
+
+	close(release)
+	scanner.Wait()
+	status = scanner.Status()
+	assert.DeepEqual(t, "list calls", listCalls, 1)
+	assert.DeepEqual(t, "status", status, ScanStatus{
+		Running:    false,
+		Trigger:    "api",
+		StartedAt:  status.StartedAt,
+		FinishedAt: status.FinishedAt,
+		PodsSeen:   7,
+		Attempts:   1,
+	})
+
+	// after the scan is finished, a new scan can be started
+	_, started = scanner.Trigger("schedule")
+	assert.DeepEqual(t, "third trigger started", started, true)
+	scanner.Wait()
+	assert.DeepEqual(t, "list calls", listCalls, 2)
+}
+
+func TestScannerShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		Description string
+		GracePeriod time.Duration
+		Saved       bool
+	}{
+		{"scan finishes within grace period", time.Minute, true},
+		{"scan is cancelled after grace period", 10 * time.Millisecond, false},
+	} {
+		clientset, err := NewFixtureClientset("testdata/pods.yaml")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// block the scan until the shutdown has begun
+		release := make(chan struct{})
+		clientset.(*fake.Clientset).PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			<-release
+			return false, nil, nil
+		})
+
+		storage := &MemoryStorage{}
+		db := newTestDatabase(t)
+		db.Storage = storage
+		db.ScanOptions.Retries = 3
+		db.ScanOptions.RetryBackoff = time.Hour
+		db.ScanOptions.ShutdownGracePeriod = tc.GracePeriod
+		ctx, cancel := context.WithCancel(context.Background())
+		scanner := NewScanner(ctx, db, clientset)
+		scanner.Trigger("schedule")
+
+		cancel()
+		_, started := scanner.Trigger("api")
+		assert.DeepEqual(t, tc.Description+": trigger after shutdown", started, false)
+		if !tc.Saved {
+			time.Sleep(5 * tc.GracePeriod)
+		}
+		close(release)
+		scanner.Wait()
+
+		status := scanner.Status()
+		assert.DeepEqual(t, tc.Description+": saved", len(storage.DailyResults) == 1, tc.Saved)
+		assert.DeepEqual(t, tc.Description+": scan failed", status.Error != "", !tc.Saved)
+		// failed attempts are not retried after shutdown
+		assert.DeepEqual(t, tc.Description+": attempts", status.Attempts, 1)
+	}
+}
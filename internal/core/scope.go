@@ -0,0 +1,105 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// OptOutAnnotation is the annotation that excludes a pod from the scan if its
+// value is "true".
+const OptOutAnnotation = "image-migration-dashboard/exclude"
+
+// ExclusionReason describes why a pod was excluded from the scan.
+type ExclusionReason string
+
+// Acceptable values for ExclusionReason.
+const (
+	ExcludedNamespaceNotIncluded ExclusionReason = "namespace not included"
+	ExcludedNamespace            ExclusionReason = "namespace excluded"
+	ExcludedBySelector           ExclusionReason = "labels do not match pod selector"
+	ExcludedByAnnotation         ExclusionReason = "opt-out annotation"
+)
+
+// Exclusion counts the pods in a namespace that were excluded from the scan
+// for the same reason.
+type Exclusion struct {
+	Namespace string          `json:"namespace"`
+	Reason    ExclusionReason `json:"reason"`
+	Pods      int             `json:"pods"`
+}
+
+// ParsePatternList parses a comma-separated list of shell glob patterns (as
+// given on the command line) and validates them.
+func ParsePatternList(input string) ([]string, error) {
+	var result []string
+	for _, pattern := range strings.Split(input, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %s", pattern, err.Error())
+		}
+		result = append(result, pattern)
+	}
+	return result, nil
+}
+
+// exclusionReason checks whether the given pod is excluded by these options,
+// and returns an empty string otherwise.
+func (o ScanOptions) exclusionReason(pod *corev1.Pod) ExclusionReason {
+	switch {
+	case matchesAnyPattern(pod.Namespace, o.ExcludeNamespaces, false):
+		return ExcludedNamespace
+	case !matchesAnyPattern(pod.Namespace, o.IncludeNamespaces, true):
+		return ExcludedNamespaceNotIncluded
+	case o.PodSelector != nil && !o.PodSelector.Matches(labels.Set(pod.Labels)):
+		return ExcludedBySelector
+	case pod.Annotations[OptOutAnnotation] == "true":
+		return ExcludedByAnnotation
+	default:
+		return ""
+	}
+}
+
+// exclusionCollector counts excluded pods by namespace and reason.
+type exclusionCollector map[Exclusion]int
+
+func (ec exclusionCollector) add(namespace string, reason ExclusionReason) {
+	ec[Exclusion{Namespace: namespace, Reason: reason}]++
+}
+
+// report returns the exclusions sorted by namespace and reason.
+func (ec exclusionCollector) report() []Exclusion {
+	var result []Exclusion
+	for e, count := range ec {
+		e.Pods = count
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Reason < result[j].Reason
+	})
+	return result
+}
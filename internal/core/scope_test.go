@@ -0,0 +1,95 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParsePatternList(t *testing.T) {
+	patterns, err := ParsePatternList(" kube-*, ,monsoon3 ")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "patterns", patterns, []string{"kube-*", "monsoon3"})
+
+	_, err = ParsePatternList("kube-[")
+	if err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
+
+func TestScanClusterWithScope(t *testing.T) {
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	selector, err := labels.Parse("app=keystone-api")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Description string
+		Options     ScanOptions
+		Pods        int
+		Exclusions  []Exclusion
+	}{
+		{
+			Description: "exclude namespaces",
+			Options:     ScanOptions{ExcludeNamespaces: []string{"kube-*"}},
+			Pods:        4,
+			Exclusions: []Exclusion{
+				{Namespace: "kube-system", Reason: ExcludedNamespace, Pods: 1},
+				{Namespace: "monsoon3", Reason: ExcludedByAnnotation, Pods: 1},
+			},
+		},
+		{
+			Description: "include namespaces",
+			// exclusion takes precedence over inclusion
+			Options: ScanOptions{IncludeNamespaces: []string{"swift", "kube-*"}, ExcludeNamespaces: []string{"kube-system"}},
+			Pods:    1,
+			Exclusions: []Exclusion{
+				{Namespace: "kube-system", Reason: ExcludedNamespace, Pods: 1},
+				{Namespace: "monsoon3", Reason: ExcludedNamespaceNotIncluded, Pods: 5},
+			},
+		},
+		{
+			Description: "pod selector",
+			Options:     ScanOptions{PodSelector: selector},
+			Pods:        2,
+			Exclusions: []Exclusion{
+				{Namespace: "kube-system", Reason: ExcludedBySelector, Pods: 1},
+				{Namespace: "monsoon3", Reason: ExcludedBySelector, Pods: 3},
+				{Namespace: "swift", Reason: ExcludedBySelector, Pods: 1},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		db := newTestDatabase(t)
+		db.ScanOptions = tc.Options
+		err = db.ScanCluster(context.Background(), clientset)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result := db.DailyResults[db.LastScrapeTime.Format(ISODateFormat)]
+		assert.DeepEqual(t, tc.Description+": pods", result.NoOfPods.Total, tc.Pods)
+		assert.DeepEqual(t, tc.Description+": exclusions", result.Exclusions, tc.Exclusions)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Spool is a local directory where the results of cluster scans are kept
+// until they have been saved to the database's storage. This ensures that
+// scans are not lost when the storage is unavailable.
+//
+// Each pending scan is stored as "<scraped_at>.json". Files are written
+// atomically and removed once the upload succeeded.
+type Spool struct {
+	Dir string
+
+	mutex sync.Mutex
+	// number of pending scans
+	depth int
+	// held while uploading
+	flushMutex sync.Mutex
+	// receives a value when a scan was added
+	wake chan struct{}
+}
+
+// spoolRecord is the content of a file in the spool.
+type spoolRecord struct {
+	Result ScanResult  `json:"result"`
+	Images ImageReport `json:"images"`
+	// nil for scans that were spooled by older versions
+	Raw *RawScan `json:"raw,omitempty"`
+}
+
+// NewSpool opens the spool in the given directory, creating it if necessary.
+func NewSpool(dir string) (*Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %s", err.Error())
+	}
+	s := &Spool{Dir: dir, wake: make(chan struct{}, 1)}
+	names, err := s.pending()
+	if err != nil {
+		return nil, err
+	}
+	s.depth = len(names)
+	if s.depth > 0 {
+		logg.Info("found %d scans in the spool that were not uploaded yet", s.depth)
+	}
+	return s, nil
+}
+
+// Depth returns the number of scans that are waiting to be uploaded.
+func (s *Spool) Depth() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.depth
+}
+
+// pending returns the file names of all pending scans, oldest first.
+func (s *Spool) pending() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %s", err.Error())
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	//zero-padded timestamps sort chronologically
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Spool) add(result ScanResult, images ImageReport, raw *RawScan) error {
+	buf, err := json.Marshal(spoolRecord{result, images, raw})
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d.json", result.ScrapedAt)
+	path := filepath.Join(s.Dir, name)
+	//write to a temporary file first, so that the uploader never sees a
+	//partially written file
+	tmpPath := filepath.Join(s.Dir, "."+name+".tmp")
+	err = ioutil.WriteFile(tmpPath, buf, 0600)
+	if err == nil {
+		_, statErr := os.Stat(path)
+		err = os.Rename(tmpPath, path)
+		if err == nil && os.IsNotExist(statErr) {
+			s.mutex.Lock()
+			s.depth++
+			s.mutex.Unlock()
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write to spool: %s", err.Error())
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Spool) read(name string) (spoolRecord, error) {
+	var record spoolRecord
+	buf, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(buf, &record)
+	return record, err
+}
+
+func (s *Spool) remove(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.depth--
+	s.mutex.Unlock()
+	return nil
+}
+
+// replay applies the pending scans to the database after the history was
+// loaded from storage.
+func (s *Spool) replay(db *Database) error {
+	names, err := s.pending()
+	if err != nil {
+		return err
+	}
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	var latest int64
+	for _, result := range db.DailyResults {
+		if result.ScrapedAt > latest {
+			latest = result.ScrapedAt
+		}
+	}
+	for _, name := range names {
+		record, err := s.read(name)
+		if err != nil {
+			logg.Error("skipping unreadable spool file %s: %s", name, err.Error())
+			continue
+		}
+		t := time.Unix(record.Result.ScrapedAt, 0).UTC()
+		date := t.Format(ISODateFormat)
+		if record.Result.ScrapedAt >= db.DailyResults[date].ScrapedAt {
+			db.DailyResults[date] = record.Result
+		}
+		if record.Result.ScrapedAt >= latest {
+			latest = record.Result.ScrapedAt
+			db.Images = record.Images
+			db.LastScrapeTime = t
+		}
+	}
+	return nil
+}
+
+// RunUploader uploads the scans from the spool to the database's storage
+// until the given context expires. Failed uploads are retried with
+// exponential backoff. Does nothing if the database has no spool.
+func (db *Database) RunUploader(ctx context.Context) {
+	if db.Spool == nil {
+		return
+	}
+	backoff := defaultRetryBackoff
+	for {
+		//nil while there is nothing to retry
+		var retry <-chan time.Time
+		err := db.FlushSpool(ctx)
+		if err == nil {
+			backoff = defaultRetryBackoff
+		} else if ctx.Err() == nil {
+			logg.Error("could not upload %d spooled scans, retrying in %s: %s", db.Spool.Depth(), backoff, err.Error())
+			retry = time.After(backoff)
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.Spool.wake:
+		case <-retry:
+		}
+	}
+}
+
+// FlushSpool uploads all scans from the spool to the database's storage,
+// oldest first. It stops at the first failed upload.
+func (db *Database) FlushSpool(ctx context.Context) error {
+	db.Spool.flushMutex.Lock()
+	defer db.Spool.flushMutex.Unlock()
+	names, err := db.Spool.pending()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		record, err := db.Spool.read(name)
+		if err != nil {
+			//do not block the spool forever, but keep the file for inspection
+			logg.Error("moving unreadable spool file %s aside: %s", name, err.Error())
+			err = os.Rename(filepath.Join(db.Spool.Dir, name), filepath.Join(db.Spool.Dir, name+".bad"))
+			if err == nil {
+				db.Spool.mutex.Lock()
+				db.Spool.depth--
+				db.Spool.mutex.Unlock()
+			}
+			continue
+		}
+		err = db.Storage.Save(ctx, record.Result, &record.Images, record.Raw)
+		db.recordUpload(err)
+		if err != nil {
+			return err
+		}
+		err = db.Spool.remove(name)
+		if err != nil {
+			return fmt.Errorf("could not remove uploaded scan from spool: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	clientset, err := NewFixtureClientset("testdata/pods.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//while the storage is down, scans succeed and are kept in the spool
+	storage := &flakyStorage{Broken: true}
+	db := newTestDatabase(t)
+	db.Storage = storage
+	db.Spool, err = NewSpool(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = db.ScanCluster(context.Background(), clientset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "spool depth after scan", db.Spool.Depth(), 1)
+	err = db.FlushSpool(context.Background())
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	assert.DeepEqual(t, "spool depth after failed upload", db.Spool.Depth(), 1)
+	report := db.Health(3, time.Now())
+	assert.DeepEqual(t, "storage health after failed upload", report.Storage, StorageHealth{
+		Status:              HealthDegraded,
+		SpoolDepth:          1,
+		ConsecutiveFailures: 1,
+		LastError:           "object store unavailable",
+	})
+	assert.DeepEqual(t, "stored results", len(storage.DailyResults), 0)
+
+	//after a restart, the spooled scan is replayed into the database
+	restarted := newTestDatabase(t)
+	restarted.Storage = storage
+	restarted.Spool, err = NewSpool(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "spool depth after restart", restarted.Spool.Depth(), 1)
+	err = restarted.LoadHistory()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "replayed results", restarted.DailyResults, db.DailyResults)
+	assert.DeepEqual(t, "replayed images", restarted.Images, db.Images)
+	assert.DeepEqual(t, "replayed scrape time", restarted.LastScrapeTime.Unix(), db.LastScrapeTime.Unix())
+
+	//once the storage is back, the uploader empties the spool
+	storage.Broken = false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go restarted.RunUploader(ctx)
+	for deadline := time.Now().Add(5 * time.Second); restarted.Spool.Depth() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("spool was not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.DeepEqual(t, "uploaded results", storage.DailyResults, db.DailyResults)
+	assert.DeepEqual(t, "storage health after upload", restarted.Health(3, time.Now()).Storage.Status, HealthOK)
+}
@@ -15,22 +15,94 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/utils/openstack/clientconfig"
 	"github.com/majewsky/schwift"
 	"github.com/majewsky/schwift/gopherschwift"
+	"github.com/sapcc/go-bits/logg"
 )
 
-// SwiftContainerName is the name of the Swift container where ScanResult
-// backups are stored.
+// Default names for the Swift container where ScanResult backups are stored,
+// and for the objects therein.
 const (
-	SwiftContainerName = "image-migration-dashboard"
-	ScanResultPrefix   = "scan-result"
+	SwiftContainerName  = "image-migration-dashboard"
+	ScanResultPrefix    = "scan-result"
+	ImageDataObjectName = "image_data"
+	RawDataPrefix       = "raw-data"
 )
 
+// SwiftOptions contains the names of the Swift container and objects that
+// SwiftStorage uses.
+type SwiftOptions struct {
+	Container string `json:"container"`
+	// Scan results are stored as "<prefix>/<date>".
+	ScanResultPrefix string `json:"scan_result_prefix"`
+	// Image data is stored as "<name>/<scraped_at>". Before format version 2,
+	// it was stored in the object "<name>" itself.
+	ImageDataObject string `json:"image_data_object"`
+	// Raw data is stored as "<prefix>/<date>" (gzipped JSON).
+	RawDataPrefix string `json:"raw_data_prefix"`
+}
+
+// DefaultSwiftOptions returns the SwiftOptions with the default names.
+func DefaultSwiftOptions() SwiftOptions {
+	return SwiftOptions{
+		Container:        SwiftContainerName,
+		ScanResultPrefix: ScanResultPrefix,
+		ImageDataObject:  ImageDataObjectName,
+		RawDataPrefix:    RawDataPrefix,
+	}
+}
+
+// Validate checks that all names are given and that they do not conflict.
+func (o SwiftOptions) Validate() error {
+	switch {
+	case o.Container == "":
+		return errors.New("container name is missing")
+	case strings.Contains(o.Container, "/"):
+		return fmt.Errorf("container name %q may not contain slashes", o.Container)
+	case o.ScanResultPrefix == "":
+		return errors.New("scan result prefix is missing")
+	case strings.HasPrefix(o.ScanResultPrefix, "/") || strings.HasSuffix(o.ScanResultPrefix, "/"):
+		return fmt.Errorf("scan result prefix %q may not start or end with a slash", o.ScanResultPrefix)
+	case o.ImageDataObject == "":
+		return errors.New("image data object name is missing")
+	case strings.HasPrefix(o.ImageDataObject, o.ScanResultPrefix+"/"):
+		return fmt.Errorf("image data object %q may not be below the scan result prefix", o.ImageDataObject)
+	case o.ImageDataObject == o.ScanResultPrefix || strings.HasPrefix(o.ScanResultPrefix, o.ImageDataObject+"/"):
+		return fmt.Errorf("scan result prefix %q may not be below the image data object", o.ScanResultPrefix)
+	case o.RawDataPrefix == "":
+		return errors.New("raw data prefix is missing")
+	case strings.HasPrefix(o.RawDataPrefix, "/") || strings.HasSuffix(o.RawDataPrefix, "/"):
+		return fmt.Errorf("raw data prefix %q may not start or end with a slash", o.RawDataPrefix)
+	case overlaps(o.RawDataPrefix, o.ScanResultPrefix) || overlaps(o.RawDataPrefix, o.ImageDataObject):
+		return fmt.Errorf("raw data prefix %q may not overlap with the scan result prefix or the image data object", o.RawDataPrefix)
+	default:
+		return nil
+	}
+}
+
+// overlaps checks whether one of the given object names is equal to the
+// other, or is a prefix of it.
+func overlaps(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
 // GetObjectStoreAccount logs in to an OpenStack cloud, acquires a token, and
 // returns the relevant Swift account.
 func GetObjectStoreAccount() (*schwift.Account, error) {
@@ -50,3 +122,456 @@ func GetObjectStoreAccount() (*schwift.Account, error) {
 
 	return account, nil
 }
+
+// Storage is the interface for persisting scan results across restarts of the
+// application.
+type Storage interface {
+	// Load populates the given database with all persisted data.
+	Load(db *Database) error
+	// Save persists the data from a single cluster scan. The raw data may be
+	// nil, e.g. for scans from older versions, in which case any raw data that
+	// is stored for the scan already is kept. The image report may be nil for
+	// scans that only come with counts (e.g. older scans from an archive), in
+	// which case Load uses the image report of the newest scan that has one.
+	Save(ctx context.Context, result ScanResult, images *ImageReport, raw *RawScan) error
+	// ForeachRawScan calls the given function with the raw data of each
+	// persisted scan, oldest first.
+	ForeachRawScan(fn func(RawScan) error) error
+	// DeleteOtherScans removes the persisted data of all scans except for
+	// those on the given dates.
+	DeleteOtherScans(ctx context.Context, keep map[string]bool) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// SwiftStorage
+
+// SwiftStorage is a Storage that stores backups in a Swift container.
+type SwiftStorage struct {
+	Container *schwift.Container
+	Options   SwiftOptions
+}
+
+// NewSwiftStorage logs in to the object store and ensures that the container
+// for backups exists.
+func NewSwiftStorage(opts SwiftOptions) (*SwiftStorage, error) {
+	acc, err := GetObjectStoreAccount()
+	if err != nil {
+		return nil, err
+	}
+	cntr, err := acc.Container(opts.Container).EnsureExists()
+	if err != nil {
+		return nil, err
+	}
+	return &SwiftStorage{Container: cntr, Options: opts}, nil
+}
+
+// storageFormatVersion is the version of the format in which SwiftStorage
+// stores scans. Version 1 (without a version field) kept the image data in a
+// single object that was overwritten by each scan, so a failed upload could
+// leave scan results and image data that do not belong together.
+const storageFormatVersion = 2
+
+// storedScanResult is the content of a scan result object. Since format
+// version 2, it references the image data object of the same scan, if any. The
+// image data is uploaded first, so a scan result only becomes visible once the
+// whole scan has been stored.
+type storedScanResult struct {
+	Version int `json:"version,omitempty"`
+	ScanResult
+	ImageDataObject string `json:"image_data_object,omitempty"`
+}
+
+// storedRawScan is the content of a raw data object.
+type storedRawScan struct {
+	Version int `json:"version"`
+	RawScan
+}
+
+// storedImageData is the content of an image data object.
+type storedImageData struct {
+	Version   int         `json:"version,omitempty"`
+	ScrapedAt int64       `json:"scraped_at,omitempty"`
+	Images    ImageReport `json:"images"`
+}
+
+// Load implements the Storage interface. If the image data of the latest scan
+// cannot be loaded, the image data of the newest scan before it that can be
+// loaded is used instead.
+func (s *SwiftStorage) Load(db *Database) error {
+	results := make(map[string]ScanResult)
+	var scans []storedScanResult
+	iter := s.Container.Objects()
+	iter.Prefix = s.Options.ScanResultPrefix + "/"
+	err := iter.Foreach(func(o *schwift.Object) error {
+		var data storedScanResult
+		err := s.download(o, &data)
+		if err != nil {
+			return err
+		}
+		if data.Version > storageFormatVersion {
+			return fmt.Errorf("%s has unsupported format version %d", o.FullName(), data.Version)
+		}
+		results[time.Unix(data.ScrapedAt, 0).UTC().Format(ISODateFormat)] = data.ScanResult
+		scans = append(scans, data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(scans, func(i, j int) bool {
+		return scans[i].ScrapedAt > scans[j].ScrapedAt
+	})
+
+	var images ImageReport
+	if len(scans) == 0 {
+		images, err = s.loadImageData(storedScanResult{})
+	}
+	failed := false
+	for _, scan := range scans {
+		if scan.Version > 1 && scan.ImageDataObject == "" {
+			//saved without an image report
+			continue
+		}
+		images, err = s.loadImageData(scan)
+		if err == nil {
+			if failed {
+				logg.Info("using image data from %s instead", scan.ImageDataObject)
+			}
+			break
+		}
+		failed = true
+		logg.Error("could not load image data from %s: %s", scan.ImageDataObject, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	for date, result := range results {
+		db.DailyResults[date] = result
+	}
+	if len(scans) > 0 {
+		db.LastScrapeTime = time.Unix(scans[0].ScrapedAt, 0).UTC()
+	}
+	db.Images = images
+	return nil
+}
+
+// loadImageData loads the image data that belongs to the given scan result.
+func (s *SwiftStorage) loadImageData(result storedScanResult) (ImageReport, error) {
+	var data storedImageData
+	if result.ImageDataObject == "" {
+		//format version 1: the image data is in a single object, if any
+		err := s.download(s.Container.Object(s.Options.ImageDataObject), &data)
+		if schwift.Is(err, http.StatusNotFound) {
+			return ImageReport{}, nil
+		}
+		return data.Images, err
+	}
+
+	obj := s.Container.Object(result.ImageDataObject)
+	err := s.download(obj, &data)
+	if err != nil {
+		return ImageReport{}, err
+	}
+	if data.ScrapedAt != result.ScrapedAt {
+		return ImageReport{}, fmt.Errorf("%s belongs to a scan at %d instead of %d",
+			obj.FullName(), data.ScrapedAt, result.ScrapedAt)
+	}
+	return data.Images, nil
+}
+
+func (s *SwiftStorage) download(obj *schwift.Object, data interface{}) error {
+	b, err := obj.Download(nil).AsByteSlice()
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, data)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", obj.FullName(), err.Error())
+	}
+	return nil
+}
+
+func (s *SwiftStorage) upload(obj *schwift.Object, data interface{}, ropts *schwift.RequestOptions) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return obj.Upload(bytes.NewReader(b), nil, ropts)
+}
+
+func (s *SwiftStorage) uploadGzipped(obj *schwift.Object, data interface{}, ropts *schwift.RequestOptions) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	err := json.NewEncoder(w).Encode(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return obj.Upload(&buf, nil, ropts)
+}
+
+// Save implements the Storage interface.
+func (s *SwiftStorage) Save(ctx context.Context, result ScanResult, images *ImageReport, raw *RawScan) error {
+	ropts := &schwift.RequestOptions{Context: ctx}
+	date := time.Unix(result.ScrapedAt, 0).UTC().Format(ISODateFormat)
+	if raw != nil {
+		obj := s.Container.Object(path.Join(s.Options.RawDataPrefix, date))
+		err := s.uploadGzipped(obj, storedRawScan{storageFormatVersion, *raw}, ropts)
+		if err != nil {
+			return err
+		}
+		logg.Info("uploaded raw data to %s", obj.FullName())
+	}
+
+	imageDataName := ""
+	if images != nil {
+		imageDataName = fmt.Sprintf("%s/%d", s.Options.ImageDataObject, result.ScrapedAt)
+		obj := s.Container.Object(imageDataName)
+		err := s.upload(obj, storedImageData{storageFormatVersion, result.ScrapedAt, *images}, ropts)
+		if err != nil {
+			return err
+		}
+		logg.Info("uploaded image data to %s", obj.FullName())
+	}
+
+	//the scan result is uploaded last, since it makes the scan visible
+	obj := s.Container.Object(path.Join(s.Options.ScanResultPrefix, date))
+	err := s.upload(obj, storedScanResult{storageFormatVersion, result, imageDataName}, ropts)
+	if err != nil {
+		return err
+	}
+	logg.Info("uploaded scan result to %s", obj.FullName())
+
+	if images != nil {
+		s.deleteOldImageData(result.ScrapedAt, ropts)
+	}
+	return nil
+}
+
+// ForeachRawScan implements the Storage interface.
+func (s *SwiftStorage) ForeachRawScan(fn func(RawScan) error) error {
+	iter := s.Container.Objects()
+	iter.Prefix = s.Options.RawDataPrefix + "/"
+	//objects are listed by name, and dates sort chronologically
+	return iter.Foreach(func(obj *schwift.Object) error {
+		reader, err := obj.Download(nil).AsReadCloser()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", obj.FullName(), err.Error())
+		}
+		var data storedRawScan
+		err = json.NewDecoder(gzipReader).Decode(&data)
+		if err != nil {
+			return fmt.Errorf("could not parse %s: %s", obj.FullName(), err.Error())
+		}
+		if data.Version > storageFormatVersion {
+			return fmt.Errorf("%s has unsupported format version %d", obj.FullName(), data.Version)
+		}
+		return fn(data.RawScan)
+	})
+}
+
+// DeleteOtherScans implements the Storage interface.
+func (s *SwiftStorage) DeleteOtherScans(ctx context.Context, keep map[string]bool) error {
+	ropts := &schwift.RequestOptions{Context: ctx}
+	deleteUnless := func(obj *schwift.Object, isKept bool) error {
+		if isKept {
+			return nil
+		}
+		err := obj.Delete(nil, ropts)
+		if err != nil && !schwift.Is(err, http.StatusNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	//the scan results go first, since they make the scans visible
+	for _, prefix := range []string{s.Options.ScanResultPrefix, s.Options.RawDataPrefix} {
+		iter := s.Container.Objects()
+		iter.Prefix = prefix + "/"
+		objects, err := iter.Collect()
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			err := deleteUnless(obj, keep[strings.TrimPrefix(obj.Name(), iter.Prefix)])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	iter := s.Container.Objects()
+	iter.Prefix = s.Options.ImageDataObject + "/"
+	objects, err := iter.Collect()
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		t, err := strconv.ParseInt(strings.TrimPrefix(obj.Name(), iter.Prefix), 10, 64)
+		err = deleteUnless(obj, err == nil && keep[time.Unix(t, 0).UTC().Format(ISODateFormat)])
+		if err != nil {
+			return err
+		}
+	}
+	//image data object from older versions
+	return deleteUnless(s.Container.Object(s.Options.ImageDataObject), false)
+}
+
+// deleteOldImageData deletes the image data of scans before the given one,
+// except for the newest of them, which is kept in case the image data of the
+// given scan cannot be loaded. Errors are only logged, since the next scan will
+// try again.
+func (s *SwiftStorage) deleteOldImageData(scrapedAt int64, ropts *schwift.RequestOptions) {
+	iter := s.Container.Objects()
+	iter.Prefix = s.Options.ImageDataObject + "/"
+	names, err := iter.Collect()
+	if err != nil {
+		logg.Error("could not list old image data: %s", err.Error())
+		return
+	}
+	old := make(map[int64]*schwift.Object)
+	var previous int64
+	for _, obj := range names {
+		t, err := strconv.ParseInt(strings.TrimPrefix(obj.Name(), iter.Prefix), 10, 64)
+		if err != nil || t >= scrapedAt {
+			continue
+		}
+		old[t] = obj
+		if t > previous {
+			previous = t
+		}
+	}
+	delete(old, previous)
+	for _, obj := range old {
+		err = obj.Delete(nil, ropts)
+		if err != nil && !schwift.Is(err, http.StatusNotFound) {
+			logg.Error("could not delete old image data %s: %s", obj.FullName(), err.Error())
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// MemoryStorage
+
+// MemoryStorage is a Storage that only keeps data in memory. It is used in
+// fixture mode and in tests.
+type MemoryStorage struct {
+	mutex        sync.Mutex
+	DailyResults map[string]ScanResult
+	Images       ImageReport
+	RawScans     map[string]RawScan
+	//the images of each saved scan by date, for when the latest scan is deleted
+	images map[string]ImageReport
+}
+
+// Load implements the Storage interface.
+func (s *MemoryStorage) Load(db *Database) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	db.RW.Lock()
+	defer db.RW.Unlock()
+	var last time.Time
+	for date, result := range s.DailyResults {
+		db.DailyResults[date] = result
+		if t := time.Unix(result.ScrapedAt, 0).UTC(); t.After(last) {
+			last = t
+		}
+	}
+	if !last.IsZero() {
+		db.LastScrapeTime = last
+	}
+	db.Images = s.Images
+	return nil
+}
+
+// Save implements the Storage interface.
+func (s *MemoryStorage) Save(ctx context.Context, result ScanResult, images *ImageReport, raw *RawScan) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.DailyResults == nil {
+		s.DailyResults = make(map[string]ScanResult)
+	}
+	if s.RawScans == nil {
+		s.RawScans = make(map[string]RawScan)
+	}
+	if s.images == nil {
+		s.images = make(map[string]ImageReport)
+	}
+	//like in SwiftStorage, the image data of the latest scan that has some is
+	//used
+	latest := true
+	for _, r := range s.DailyResults {
+		if r.ScrapedAt > result.ScrapedAt {
+			latest = false
+		}
+	}
+	date := time.Unix(result.ScrapedAt, 0).UTC().Format(ISODateFormat)
+	s.DailyResults[date] = result
+	if images == nil {
+		delete(s.images, date)
+	} else {
+		s.images[date] = *images
+		if latest {
+			s.Images = *images
+		}
+	}
+	if raw != nil {
+		s.RawScans[date] = *raw
+	}
+	return nil
+}
+
+// ForeachRawScan implements the Storage interface.
+func (s *MemoryStorage) ForeachRawScan(fn func(RawScan) error) error {
+	s.mutex.Lock()
+	var scans []RawScan
+	for _, raw := range s.RawScans {
+		scans = append(scans, raw)
+	}
+	s.mutex.Unlock()
+	sort.Slice(scans, func(i, j int) bool { return scans[i].ScrapedAt < scans[j].ScrapedAt })
+	for _, raw := range scans {
+		err := fn(raw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteOtherScans implements the Storage interface.
+func (s *MemoryStorage) DeleteOtherScans(ctx context.Context, keep map[string]bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for date := range s.RawScans {
+		if !keep[date] {
+			delete(s.RawScans, date)
+		}
+	}
+	latestDate := ""
+	for date := range s.DailyResults {
+		if !keep[date] {
+			delete(s.DailyResults, date)
+		} else if date > latestDate {
+			latestDate = date
+		}
+	}
+	if images, exists := s.images[latestDate]; exists || latestDate == "" {
+		s.Images = images
+	}
+	for date := range s.images {
+		if !keep[date] {
+			delete(s.images, date)
+		}
+	}
+	return nil
+}
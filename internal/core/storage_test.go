@@ -0,0 +1,338 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/assert"
+)
+
+// fakeSwift is a schwift.Backend that keeps the objects of a single account
+// in memory. It only supports what SwiftStorage needs.
+type fakeSwift struct {
+	mutex   sync.Mutex
+	objects map[string][]byte // key is "container/object"
+	// uploads of these objects fail
+	broken map[string]bool
+}
+
+func newFakeSwift() *fakeSwift {
+	return &fakeSwift{objects: make(map[string][]byte), broken: make(map[string]bool)}
+}
+
+func (f *fakeSwift) EndpointURL() string                         { return "http://swift.example.com/v1/AUTH_test/" }
+func (f *fakeSwift) Clone(newEndpointURL string) schwift.Backend { return f }
+
+func (f *fakeSwift) Do(req *http.Request) (*http.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	respond := func(code int, body []byte, hdr http.Header) (*http.Response, error) {
+		if hdr == nil {
+			hdr = make(http.Header)
+		}
+		return &http.Response{StatusCode: code, Header: hdr, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/AUTH_test/"), "/")
+	if !strings.Contains(path, "/") {
+		//list objects in container
+		query := req.URL.Query()
+		var names []string
+		for key := range f.objects {
+			name := strings.TrimPrefix(key, path+"/")
+			if name != key && strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return respond(http.StatusNoContent, nil, nil)
+		}
+		return respond(http.StatusOK, []byte(strings.Join(names, "\n")+"\n"), nil)
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if body, exists := f.objects[path]; exists {
+			return respond(http.StatusOK, body, nil)
+		}
+		return respond(http.StatusNotFound, nil, nil)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if f.broken[path] {
+			return respond(http.StatusServiceUnavailable, nil, nil)
+		}
+		f.objects[path] = body
+		sum := md5.Sum(body)
+		return respond(http.StatusCreated, nil, http.Header{"Etag": {hex.EncodeToString(sum[:])}})
+	case http.MethodDelete:
+		if _, exists := f.objects[path]; !exists {
+			return respond(http.StatusNotFound, nil, nil)
+		}
+		delete(f.objects, path)
+		return respond(http.StatusNoContent, nil, nil)
+	default:
+		return respond(http.StatusMethodNotAllowed, nil, nil)
+	}
+}
+
+func (f *fakeSwift) objectNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var names []string
+	for key := range f.objects {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestSwiftStorage(t *testing.T, backend *fakeSwift) *SwiftStorage {
+	t.Helper()
+	account, err := schwift.InitializeAccount(backend)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &SwiftStorage{Container: account.Container("test"), Options: DefaultSwiftOptions()}
+}
+
+func testScan(day int) (ScanResult, ImageReport) {
+	scrapedAt := time.Date(2020, 6, day, 12, 0, 0, 0, time.UTC).Unix()
+	images := ImageReport{Quay: []Image{{Name: fmt.Sprintf("hub.example.com/app:%d", day), FirstSeen: scrapedAt}}}
+	result := ScanResult{ScrapedAt: scrapedAt}
+	result.CountImages(images)
+	return result, images
+}
+
+// utcDate returns the date (in UTC) that the given scan is stored under.
+func utcDate(result ScanResult) string {
+	return time.Unix(result.ScrapedAt, 0).UTC().Format(ISODateFormat)
+}
+
+func TestSwiftStorageSaveAndLoad(t *testing.T) {
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	ctx := context.Background()
+	result1, images1 := testScan(1)
+	result2, images2 := testScan(2)
+	result3, images3 := testScan(3)
+
+	for _, scan := range []struct {
+		Result ScanResult
+		Images ImageReport
+	}{{result1, images1}, {result2, images2}, {result3, images3}} {
+		err := storage.Save(ctx, scan.Result, &scan.Images, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	//only the image data of the latest scan and the one before is kept
+	assert.DeepEqual(t, "objects", backend.objectNames(), []string{
+		fmt.Sprintf("test/image_data/%d", result2.ScrapedAt),
+		fmt.Sprintf("test/image_data/%d", result3.ScrapedAt),
+		"test/scan-result/" + utcDate(result1),
+		"test/scan-result/" + utcDate(result2),
+		"test/scan-result/" + utcDate(result3),
+	})
+
+	db := newTestDatabase(t)
+	err := storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{
+		utcDate(result1): result1,
+		utcDate(result2): result2,
+		utcDate(result3): result3,
+	})
+	assert.DeepEqual(t, "images", db.Images, images3)
+	assert.DeepEqual(t, "last scrape time", db.LastScrapeTime.Unix(), result3.ScrapedAt)
+}
+
+func TestSwiftStorageMissingImageData(t *testing.T) {
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	ctx := context.Background()
+	result1, images1 := testScan(1)
+	result2, images2 := testScan(2)
+	for _, scan := range []struct {
+		Result ScanResult
+		Images ImageReport
+	}{{result1, images1}, {result2, images2}} {
+		err := storage.Save(ctx, scan.Result, &scan.Images, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//if the image data of the latest scan is missing or unreadable, the image
+	//data of the previous scan is used
+	latestImageData := fmt.Sprintf("test/image_data/%d", result2.ScrapedAt)
+	for _, content := range [][]byte{nil, []byte("{")} {
+		delete(backend.objects, latestImageData)
+		if content != nil {
+			backend.objects[latestImageData] = content
+		}
+		db := newTestDatabase(t)
+		err := storage.Load(db)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{
+			utcDate(result1): result1,
+			utcDate(result2): result2,
+		})
+		assert.DeepEqual(t, "images", db.Images, images1)
+		assert.DeepEqual(t, "last scrape time", db.LastScrapeTime.Unix(), result2.ScrapedAt)
+	}
+
+	//if no image data can be loaded at all, loading fails
+	delete(backend.objects, fmt.Sprintf("test/image_data/%d", result1.ScrapedAt))
+	err := storage.Load(newTestDatabase(t))
+	if err == nil {
+		t.Fatal("expected loading to fail without any image data")
+	}
+}
+
+func TestSwiftStorageWithoutImageData(t *testing.T) {
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	ctx := context.Background()
+	result1, images1 := testScan(1)
+	result2, _ := testScan(2)
+	err := storage.Save(ctx, result1, &images1, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//a scan without an image report does not upload any image data, and the
+	//image data of the newest scan that has some is used
+	err = storage.Save(ctx, result2, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects", backend.objectNames(), []string{
+		fmt.Sprintf("test/image_data/%d", result1.ScrapedAt),
+		"test/scan-result/" + utcDate(result1),
+		"test/scan-result/" + utcDate(result2),
+	})
+	db := newTestDatabase(t)
+	err = storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{
+		utcDate(result1): result1,
+		utcDate(result2): result2,
+	})
+	assert.DeepEqual(t, "images", db.Images, images1)
+	assert.DeepEqual(t, "last scrape time", db.LastScrapeTime.Unix(), result2.ScrapedAt)
+}
+
+func TestSwiftStorageIncompleteScan(t *testing.T) {
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	ctx := context.Background()
+	result1, images1 := testScan(1)
+	result2, images2 := testScan(2)
+	err := storage.Save(ctx, result1, &images1, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//if the scan result cannot be uploaded, the scan is not visible, even
+	//though its image data was uploaded
+	backend.broken["test/scan-result/"+utcDate(result2)] = true
+	err = storage.Save(ctx, result2, &images2, nil)
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	db := newTestDatabase(t)
+	err = storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{utcDate(result1): result1})
+	assert.DeepEqual(t, "images", db.Images, images1)
+}
+
+func TestSwiftStorageLegacyFormat(t *testing.T) {
+	backend := newFakeSwift()
+	//1591012800 is 2020-06-01 12:00 UTC
+	backend.objects["test/scan-result/2020-06-01"] = []byte(`{"scraped_at":1591012800,"no_of_images":{"total":1,"quay":1}}`)
+	backend.objects["test/image_data"] = []byte(`{"images":{"quay":[{"name":"hub.example.com/app:1","containers":["monsoon3/app/app"]}]}}`)
+	storage := newTestSwiftStorage(t, backend)
+
+	db := newTestDatabase(t)
+	err := storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{
+		"2020-06-01": {ScrapedAt: 1591012800, NoOfImages: Counts{Total: 1, Quay: 1}},
+	})
+	assert.DeepEqual(t, "images", db.Images, ImageReport{Quay: []Image{
+		{Name: "hub.example.com/app:1", Containers: []Container{{Name: "monsoon3/app/app"}}},
+	}})
+
+	//scans from newer versions are not trusted
+	backend.objects["test/scan-result/2020-06-02"] = []byte(`{"version":99,"scraped_at":1591099200}`)
+	err = storage.Load(newTestDatabase(t))
+	assert.DeepEqual(t, "error for unknown version", err.Error(),
+		"test/scan-result/2020-06-02 has unsupported format version 99")
+}
+
+func TestSwiftStorageUsesUTCDates(t *testing.T) {
+	//in UTC+14, this scan happened on the next day already
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("UTC+14", 14*60*60)
+
+	backend := newFakeSwift()
+	storage := newTestSwiftStorage(t, backend)
+	result, images := testScan(1)
+	err := storage.Save(context.Background(), result, &images, &RawScan{ScrapedAt: result.ScrapedAt})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects", backend.objectNames(), []string{
+		fmt.Sprintf("test/image_data/%d", result.ScrapedAt),
+		"test/raw-data/2020-06-01",
+		"test/scan-result/2020-06-01",
+	})
+
+	db := newTestDatabase(t)
+	err = storage.Load(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "daily results", db.DailyResults, map[string]ScanResult{"2020-06-01": result})
+	assert.DeepEqual(t, "date of last scan", db.LastScrapeTime.Format(ISODateFormat), "2020-06-01")
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook implements Kubernetes admission webhooks that apply the
+// registry classification of the collector to incoming pods.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sapcc/go-bits/logg"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// admissionReview is the request and response body of an admission webhook.
+// The request format is identical in admission.k8s.io/v1beta1 and v1, so the
+// response uses the same API version as the request.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionv1beta1.AdmissionRequest `json:"request,omitempty"`
+	Response        *admissionResponse                 `json:"response,omitempty"`
+}
+
+// admissionResponse is admissionv1beta1.AdmissionResponse plus the "warnings"
+// field, which was only added in Kubernetes 1.19 and is therefore missing from
+// our version of k8s.io/api. Older API servers ignore it.
+type admissionResponse struct {
+	UID       types.UID                   `json:"uid"`
+	Allowed   bool                        `json:"allowed"`
+	Result    *metav1.Status              `json:"status,omitempty"`
+	Patch     []byte                      `json:"patch,omitempty"`
+	PatchType *admissionv1beta1.PatchType `json:"patchType,omitempty"`
+	Warnings  []string                    `json:"warnings,omitempty"`
+}
+
+// reviewFunc decides about a single admission request for a pod.
+type reviewFunc func(ctx context.Context, req *admissionv1beta1.AdmissionRequest, pod *corev1.Pod) *admissionResponse
+
+// serveAdmissionReview implements the HTTP part of the AdmissionReview
+// protocol for webhooks that handle pods.
+func serveAdmissionReview(w http.ResponseWriter, r *http.Request, review reviewFunc) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data admissionReview
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.Request == nil {
+		http.Error(w, "request body is not a valid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	req := data.Request
+	var response *admissionResponse
+	switch {
+	case req.Kind.Group != "" || req.Kind.Kind != "Pod":
+		// we are only interested in pods; everything else is allowed
+		response = &admissionResponse{Allowed: true}
+	case len(req.Object.Raw) == 0:
+		// requests without an object (e.g. DELETE) cannot add any images
+		response = &admissionResponse{Allowed: true}
+	default:
+		var pod corev1.Pod
+		err = json.Unmarshal(req.Object.Raw, &pod)
+		if err != nil {
+			logg.Error("could not decode pod in admission request %s: %s", req.UID, err.Error())
+			response = &admissionResponse{
+				Allowed: false,
+				Result: &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Message: fmt.Sprintf("could not decode pod: %s", err.Error()),
+					Code:    http.StatusBadRequest,
+				},
+			}
+		} else {
+			if pod.Namespace == "" {
+				pod.Namespace = req.Namespace
+			}
+			response = review(r.Context(), req, &pod)
+		}
+	}
+	response.UID = req.UID
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(admissionReview{
+		TypeMeta: data.TypeMeta,
+		Response: response,
+	})
+	if err != nil {
+		logg.Error("could not write admission response: %s", err.Error())
+	}
+}
+
+// podName returns a name for the pod that is suitable for display. Pods
+// created by controllers do not have a name yet during admission.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName + "*"
+}
+
+// allContainers returns pointers to all containers and init containers of the
+// given pod.
+func allContainers(pod *corev1.Pod) []*corev1.Container {
+	var result []*corev1.Container
+	for idx := range pod.Spec.InitContainers {
+		result = append(result, &pod.Spec.InitContainers[idx])
+	}
+	for idx := range pod.Spec.Containers {
+		result = append(result, &pod.Spec.Containers[idx])
+	}
+	return result
+}
+
+// previousImages returns the images of the containers in the old object of
+// an UPDATE request by container name, or nil for other requests.
+func previousImages(req *admissionv1beta1.AdmissionRequest) map[string]string {
+	if req.Operation != admissionv1beta1.Update || len(req.OldObject.Raw) == 0 {
+		return nil
+	}
+	var old corev1.Pod
+	err := json.Unmarshal(req.OldObject.Raw, &old)
+	if err != nil {
+		//all containers will be checked
+		logg.Error("could not decode old pod in admission request %s: %s", req.UID, err.Error())
+		return nil
+	}
+	result := make(map[string]string)
+	for _, c := range allContainers(&old) {
+		result[c.Name] = c.Image
+	}
+	return result
+}
+
+func isDryRun(req *admissionv1beta1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// RewriteRule describes how images from Quay are mapped to their Keppel
+// counterparts.
+type RewriteRule struct {
+	// From is a prefix of images on Quay, e.g. "hub.global.cloud.sap/monsoon/".
+	From string `json:"from"`
+	// To is the prefix that replaces From, e.g. "keppel.eu-de-1.cloud.sap/ccloud/".
+	To string `json:"to"`
+}
+
+// ReadRewriteRules reads a list of RewriteRules from the given YAML or JSON
+// file. The file contains an object with a single key "rewrites".
+func ReadRewriteRules(filePath string) ([]RewriteRule, error) {
+	var data struct {
+		Rewrites []RewriteRule `json:"rewrites"`
+	}
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(b, &data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rewrite rules %s: %s", filePath, err.Error())
+	}
+	if len(data.Rewrites) == 0 {
+		return nil, fmt.Errorf("%s does not contain any rewrite rules", filePath)
+	}
+
+	for idx, rule := range data.Rewrites {
+		//use a dummy image name to check that the rule actually moves images
+		//from Quay to Keppel
+		if core.ClassifyImage(rule.From+"image") != core.RegistryQuay {
+			return nil, fmt.Errorf("rewrite rule %d: %q is not a prefix for Quay images", idx+1, rule.From)
+		}
+		if core.ClassifyImage(rule.To+"image") != core.RegistryKeppel {
+			return nil, fmt.Errorf("rewrite rule %d: %q is not a prefix for Keppel images", idx+1, rule.To)
+		}
+	}
+	return data.Rewrites, nil
+}
+
+// Mutator is a mutating admission webhook that rewrites images from Quay to
+// their Keppel counterparts in pods of namespaces that opted into automatic
+// migration.
+type Mutator struct {
+	Rewrites  []RewriteRule
+	Clientset kubernetes.Interface
+	// Only pods in namespaces with matching labels are mutated.
+	NamespaceSelector labels.Selector
+	Stats             *Stats
+	// for tests
+	now func() time.Time
+
+	//whether each namespace matches the NamespaceSelector, so that the API
+	//server is not asked for every pod
+	mutex      sync.Mutex
+	namespaces map[string]namespaceMatch
+}
+
+// namespaceMatchTTL is how long Mutator remembers whether a namespace matches
+// its NamespaceSelector.
+const namespaceMatchTTL = time.Minute
+
+type namespaceMatch struct {
+	Matches   bool
+	ExpiresAt time.Time
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (m *Mutator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveAdmissionReview(w, r, m.review)
+}
+
+// jsonPatchOperation is a single operation of a JSONPatch (RFC 6902).
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+func (m *Mutator) review(ctx context.Context, req *admissionv1beta1.AdmissionRequest, pod *corev1.Pod) *admissionResponse {
+	//never block pods because of this webhook, it's only a convenience
+	response := &admissionResponse{Allowed: true}
+
+	matches, err := m.namespaceMatches(ctx, pod.Namespace)
+	if err != nil {
+		logg.Error("could not get namespace %s for mutating pod: %s", pod.Namespace, err.Error())
+		return response
+	}
+	if !matches {
+		return response
+	}
+
+	var (
+		patch    []jsonPatchOperation
+		messages []string
+	)
+	for idx, c := range pod.Spec.InitContainers {
+		if newImage, ok := m.rewrite(c.Image); ok {
+			patch = append(patch, jsonPatchOperation{"replace", fmt.Sprintf("/spec/initContainers/%d/image", idx), newImage})
+			messages = append(messages, fmt.Sprintf("container %q: %s -> %s", c.Name, c.Image, newImage))
+		}
+	}
+	for idx, c := range pod.Spec.Containers {
+		if newImage, ok := m.rewrite(c.Image); ok {
+			patch = append(patch, jsonPatchOperation{"replace", fmt.Sprintf("/spec/containers/%d/image", idx), newImage})
+			messages = append(messages, fmt.Sprintf("container %q: %s -> %s", c.Name, c.Image, newImage))
+		}
+	}
+	if len(patch) == 0 {
+		return response
+	}
+
+	response.Patch, err = json.Marshal(patch)
+	if err != nil {
+		logg.Error("could not serialize patch for pod %s/%s: %s", pod.Namespace, podName(pod), err.Error())
+		return &admissionResponse{Allowed: true}
+	}
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	response.PatchType = &patchType
+
+	//requests from `kubectl --dry-run=server` do not create anything, so they
+	//are not counted
+	if !isDryRun(req) {
+		for _, msg := range messages {
+			logg.Info("rewriting image for pod %s/%s: %s", pod.Namespace, podName(pod), msg)
+		}
+		if m.Stats != nil {
+			m.Stats.record(pod.Namespace,
+				func(ns *NamespaceStats) { ns.Rewritten++ },
+				&Event{
+					Time:      time.Now(),
+					Namespace: pod.Namespace,
+					Pod:       podName(pod),
+					Action:    "rewritten",
+					Messages:  messages,
+				},
+			)
+		}
+	}
+	return response
+}
+
+// namespaceMatches checks whether the labels of the given namespace match the
+// NamespaceSelector. The outcome is cached for namespaceMatchTTL, so label
+// changes take effect with a delay.
+func (m *Mutator) namespaceMatches(ctx context.Context, namespace string) (bool, error) {
+	now := time.Now()
+	if m.now != nil {
+		now = m.now()
+	}
+	m.mutex.Lock()
+	entry, exists := m.namespaces[namespace]
+	m.mutex.Unlock()
+	if exists && now.Before(entry.ExpiresAt) {
+		return entry.Matches, nil
+	}
+
+	ns, err := m.Clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		//do not cache errors, the next request shall try again
+		return false, err
+	}
+	matches := m.NamespaceSelector.Matches(labels.Set(ns.Labels))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.namespaces == nil {
+		m.namespaces = make(map[string]namespaceMatch)
+	}
+	for name, e := range m.namespaces {
+		if !now.Before(e.ExpiresAt) {
+			delete(m.namespaces, name)
+		}
+	}
+	m.namespaces[namespace] = namespaceMatch{matches, now.Add(namespaceMatchTTL)}
+	return matches, nil
+}
+
+// rewrite returns the Keppel counterpart of the given image if it is a Quay
+// image that matches one of the rewrite rules.
+func (m *Mutator) rewrite(image string) (string, bool) {
+	if core.ClassifyImage(image) != core.RegistryQuay {
+		return "", false
+	}
+	for _, rule := range m.Rewrites {
+		if strings.HasPrefix(image, rule.From) {
+			return rule.To + strings.TrimPrefix(image, rule.From), true
+		}
+	}
+	return "", false
+}
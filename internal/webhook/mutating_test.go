@@ -0,0 +1,116 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMutator(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "monsoon3",
+			Labels: map[string]string{"image-migration-dashboard/auto-migrate": "true"},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "kube-system",
+		}},
+	)
+	m := &Mutator{
+		Rewrites: []RewriteRule{{
+			From: "hub.global.cloud.sap/monsoon/",
+			To:   "keppel.eu-de-1.cloud.sap/ccloud/",
+		}},
+		Clientset:         clientset,
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"image-migration-dashboard/auto-migrate": "true"}),
+		Stats:             NewStats(),
+	}
+
+	resp := doReview(t, m, "monsoon3",
+		"keppel.eu-de-1.cloud.sap/ccloud/nova:stein",
+		"hub.global.cloud.sap/monsoon/nova:rocky",
+		"hub.global.cloud.sap/other/thing:latest",
+	)
+	assert.DeepEqual(t, "allowed", resp.Allowed, true)
+	assert.DeepEqual(t, "patch", string(resp.Patch),
+		`[{"op":"replace","path":"/spec/containers/1/image","value":"keppel.eu-de-1.cloud.sap/ccloud/nova:rocky"}]`)
+
+	//namespace without the label is not touched
+	resp = doReview(t, m, "kube-system", "hub.global.cloud.sap/monsoon/nova:rocky")
+	assert.DeepEqual(t, "allowed", resp.Allowed, true)
+	assert.DeepEqual(t, "patch", len(resp.Patch), 0)
+
+	assert.DeepEqual(t, "stats", m.Stats.Namespaces(), []NamespaceStats{
+		{Namespace: "monsoon3", Rewritten: 1},
+	})
+}
+
+func TestMutatorCachesNamespaces(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "monsoon3",
+			Labels: map[string]string{"image-migration-dashboard/auto-migrate": "true"},
+		}},
+	)
+	gets := 0
+	clientset.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+	now := time.Unix(1591012800, 0)
+	m := &Mutator{
+		Rewrites: []RewriteRule{{
+			From: "hub.global.cloud.sap/monsoon/",
+			To:   "keppel.eu-de-1.cloud.sap/ccloud/",
+		}},
+		Clientset:         clientset,
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"image-migration-dashboard/auto-migrate": "true"}),
+		Stats:             NewStats(),
+		now:               func() time.Time { return now },
+	}
+
+	//the namespace is only looked up once per namespaceMatchTTL
+	for i := 0; i < 3; i++ {
+		resp := doReview(t, m, "monsoon3", "hub.global.cloud.sap/monsoon/nova:rocky")
+		assert.DeepEqual(t, "patch", len(resp.Patch) > 0, true)
+	}
+	assert.DeepEqual(t, "GETs before expiry", gets, 1)
+
+	//label changes are seen after the cache entry expired
+	ns, err := clientset.CoreV1().Namespaces().Get(context.Background(), "monsoon3", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ns.Labels = nil
+	_, err = clientset.CoreV1().Namespaces().Update(context.Background(), ns, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gets = 0
+	now = now.Add(namespaceMatchTTL)
+	resp := doReview(t, m, "monsoon3", "hub.global.cloud.sap/monsoon/nova:rocky")
+	assert.DeepEqual(t, "patch after expiry", len(resp.Patch), 0)
+	assert.DeepEqual(t, "GETs after expiry", gets, 1)
+}
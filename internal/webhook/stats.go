@@ -0,0 +1,109 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents is the number of events that Stats remembers.
+const maxRecentEvents = 50
+
+// Stats counts the decisions of the admission webhooks. It is only held in
+// memory and starts from zero when the application is restarted.
+type Stats struct {
+	mutex      sync.Mutex
+	namespaces map[string]*NamespaceStats
+	recent     []Event
+}
+
+// NamespaceStats contains the counters for a single namespace.
+type NamespaceStats struct {
+	Namespace string
+	Allowed   int
+	Warned    int
+	Denied    int
+	// WouldDeny counts pods that were allowed only because of dry-run mode.
+	WouldDeny int
+	// Rewritten counts pods whose images were rewritten to Keppel.
+	Rewritten int
+}
+
+// Event describes a single admission decision that was not a plain "allow".
+type Event struct {
+	Time      time.Time
+	Namespace string
+	Pod       string
+	Action    string // "warned", "denied", "would deny" or "rewritten"
+	Messages  []string
+}
+
+// NewStats initializes a new Stats instance.
+func NewStats() *Stats {
+	return &Stats{namespaces: make(map[string]*NamespaceStats)}
+}
+
+// namespace returns the counters for the given namespace. The caller must hold
+// the mutex.
+func (s *Stats) namespace(name string) *NamespaceStats {
+	ns, exists := s.namespaces[name]
+	if !exists {
+		ns = &NamespaceStats{Namespace: name}
+		s.namespaces[name] = ns
+	}
+	return ns
+}
+
+// record updates the counters for the given namespace, and remembers the
+// event if there is one.
+func (s *Stats) record(namespace string, update func(*NamespaceStats), event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update(s.namespace(namespace))
+	if event != nil {
+		s.recent = append(s.recent, *event)
+		if len(s.recent) > maxRecentEvents {
+			s.recent = s.recent[len(s.recent)-maxRecentEvents:]
+		}
+	}
+}
+
+// Namespaces returns a copy of the counters for all namespaces, sorted by
+// name.
+func (s *Stats) Namespaces() []NamespaceStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]NamespaceStats, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		result = append(result, *ns)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result
+}
+
+// RecentEvents returns a copy of the most recent events, newest first.
+func (s *Stats) RecentEvents() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]Event, len(s.recent))
+	for idx, e := range s.recent {
+		result[len(s.recent)-1-idx] = e
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Validator is a validating admission webhook that warns about or denies pods
+// using images from registries that are forbidden by the policy.
+type Validator struct {
+	Policy core.Policy
+	// In dry-run mode, pods are never denied. Would-be denials are only
+	// counted in the Stats.
+	DryRun bool
+	Stats  *Stats
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveAdmissionReview(w, r, v.review)
+}
+
+func (v *Validator) review(_ context.Context, req *admissionv1beta1.AdmissionRequest, pod *corev1.Pod) *admissionResponse {
+	var (
+		denials  []string
+		warnings []string
+	)
+	//on UPDATE, only changed images are checked, so that existing pods with
+	//forbidden images can still be modified (e.g. to remove finalizers)
+	previous := previousImages(req)
+	for _, c := range allContainers(pod) {
+		if image, exists := previous[c.Name]; exists && image == c.Image {
+			continue
+		}
+		reg := core.ClassifyImage(c.Image)
+		rule := v.Policy.MatchRule(reg, pod.Namespace)
+		if rule == nil {
+			continue
+		}
+		msg := fmt.Sprintf("container %q uses image %s from %s (%s)",
+			c.Name, c.Image, reg.DisplayName(), rule.String())
+		if rule.ActionOrDefault() == core.PolicyActionDeny {
+			denials = append(denials, msg)
+		} else {
+			warnings = append(warnings, msg)
+		}
+	}
+
+	response := &admissionResponse{Allowed: true, Warnings: warnings}
+	event := &Event{
+		Time:      time.Now(),
+		Namespace: pod.Namespace,
+		Pod:       podName(pod),
+	}
+	var update func(*NamespaceStats)
+	switch {
+	case len(denials) > 0 && v.DryRun:
+		event.Action = "would deny"
+		event.Messages = append(denials, warnings...)
+		update = func(ns *NamespaceStats) { ns.WouldDeny++ }
+	case len(denials) > 0:
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: "images from deprecated registries are not allowed: " + strings.Join(denials, "; "),
+		}
+		event.Action = "denied"
+		event.Messages = append(denials, warnings...)
+		update = func(ns *NamespaceStats) { ns.Denied++ }
+	case len(warnings) > 0:
+		event.Action = "warned"
+		event.Messages = warnings
+		update = func(ns *NamespaceStats) { ns.Warned++ }
+	default:
+		event = nil
+		update = func(ns *NamespaceStats) { ns.Allowed++ }
+	}
+
+	//requests from `kubectl --dry-run=server` do not create anything, so they
+	//are not counted
+	if v.Stats != nil && !isDryRun(req) {
+		v.Stats.record(pod.Namespace, update, event)
+	}
+	return response
+}
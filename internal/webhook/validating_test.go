@@ -0,0 +1,162 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+var testPolicy = core.Policy{Rules: []core.PolicyRule{
+	{Description: "no Quay", Registries: []core.Registry{core.RegistryQuay}, Namespaces: []string{"monsoon3"}},
+	{Description: "no Docker Hub", Action: core.PolicyActionWarn, Registries: []core.Registry{core.RegistryDockerHub}},
+}}
+
+// testPod returns a pod with the given images in the form of an admission
+// request object.
+func testPod(images ...string) map[string]interface{} {
+	var containers []map[string]string
+	for idx, image := range images {
+		containers = append(containers, map[string]string{"name": fmt.Sprintf("c%d", idx), "image": image})
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]string{"generateName": "test-"},
+		"spec":       map[string]interface{}{"containers": containers},
+	}
+}
+
+// doReview sends an AdmissionReview for the creation of a pod with the given
+// images to the given handler, and returns the response.
+func doReview(t *testing.T, handler http.Handler, namespace string, images ...string) admissionResponse {
+	t.Helper()
+	return sendReview(t, handler, map[string]interface{}{
+		"namespace": namespace,
+		"operation": "CREATE",
+		"object":    testPod(images...),
+	})
+}
+
+// sendReview sends an AdmissionReview for a pod with the given request fields
+// to the given handler, and returns the response.
+func sendReview(t *testing.T, handler http.Handler, request map[string]interface{}) admissionResponse {
+	t.Helper()
+	request["uid"] = "a6b5c4d3"
+	request["kind"] = map[string]string{"group": "", "version": "v1", "kind": "Pod"}
+	review := map[string]interface{}{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind":       "AdmissionReview",
+		"request":    request,
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var result admissionReview
+	err = json.Unmarshal(rec.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "API version", result.APIVersion, "admission.k8s.io/v1")
+	assert.DeepEqual(t, "UID", string(result.Response.UID), "a6b5c4d3")
+	return *result.Response
+}
+
+func TestValidator(t *testing.T) {
+	v := &Validator{Policy: testPolicy, Stats: NewStats()}
+
+	resp := doReview(t, v, "monsoon3", "keppel.eu-de-1.cloud.sap/ccloud/nova:stein")
+	assert.DeepEqual(t, "allowed for Keppel image", resp.Allowed, true)
+	assert.DeepEqual(t, "warnings for Keppel image", len(resp.Warnings), 0)
+
+	resp = doReview(t, v, "monsoon3", "library/alpine:3.11")
+	assert.DeepEqual(t, "allowed for Docker Hub image", resp.Allowed, true)
+	assert.DeepEqual(t, "warnings for Docker Hub image", resp.Warnings, []string{
+		`container "c0" uses image library/alpine:3.11 from Docker Hub (no Docker Hub)`,
+	})
+
+	resp = doReview(t, v, "monsoon3", "hub.global.cloud.sap/monsoon/nova:rocky")
+	assert.DeepEqual(t, "allowed for Quay image", resp.Allowed, false)
+
+	resp = doReview(t, v, "kube-system", "hub.global.cloud.sap/monsoon/nova:rocky")
+	assert.DeepEqual(t, "allowed for Quay image in other namespace", resp.Allowed, true)
+
+	assert.DeepEqual(t, "stats", v.Stats.Namespaces(), []NamespaceStats{
+		{Namespace: "kube-system", Allowed: 1},
+		{Namespace: "monsoon3", Allowed: 1, Warned: 1, Denied: 1},
+	})
+	assert.DeepEqual(t, "number of events", len(v.Stats.RecentEvents()), 2)
+}
+
+func TestValidatorDryRun(t *testing.T) {
+	v := &Validator{Policy: testPolicy, DryRun: true, Stats: NewStats()}
+
+	resp := doReview(t, v, "monsoon3", "hub.global.cloud.sap/monsoon/nova:rocky")
+	assert.DeepEqual(t, "allowed for Quay image", resp.Allowed, true)
+	assert.DeepEqual(t, "stats", v.Stats.Namespaces(), []NamespaceStats{
+		{Namespace: "monsoon3", WouldDeny: 1},
+	})
+	assert.DeepEqual(t, "event action", v.Stats.RecentEvents()[0].Action, "would deny")
+	assert.DeepEqual(t, "event pod", v.Stats.RecentEvents()[0].Pod, "test-*")
+}
+
+func TestValidatorUpdate(t *testing.T) {
+	v := &Validator{Policy: testPolicy, Stats: NewStats()}
+	quay := "hub.global.cloud.sap/monsoon/nova:rocky"
+	keppel := "keppel.eu-de-1.cloud.sap/ccloud/nova:stein"
+
+	//an existing pod with a denied image can still be changed, e.g. when its
+	//labels or finalizers are updated
+	resp := sendReview(t, v, map[string]interface{}{
+		"namespace": "monsoon3",
+		"operation": "UPDATE",
+		"object":    testPod(quay, keppel),
+		"oldObject": testPod(quay, keppel),
+	})
+	assert.DeepEqual(t, "allowed for UPDATE of unchanged pod", resp.Allowed, true)
+
+	//but its images cannot be changed to denied ones
+	resp = sendReview(t, v, map[string]interface{}{
+		"namespace": "monsoon3",
+		"operation": "UPDATE",
+		"object":    testPod(quay, quay),
+		"oldObject": testPod(quay, keppel),
+	})
+	assert.DeepEqual(t, "allowed for UPDATE to denied image", resp.Allowed, false)
+	assert.DeepEqual(t, "message for UPDATE to denied image", resp.Result.Message,
+		`images from deprecated registries are not allowed: container "c1" uses image `+quay+` from Quay (no Quay)`)
+
+	//requests without an object are allowed
+	resp = sendReview(t, v, map[string]interface{}{
+		"namespace": "monsoon3",
+		"operation": "DELETE",
+		"oldObject": testPod(quay),
+	})
+	assert.DeepEqual(t, "allowed for DELETE", resp.Allowed, true)
+}
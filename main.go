@@ -16,25 +16,39 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
-	"github.com/majewsky/schwift"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/utils/openstack/clientconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/go-bits/httpee"
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/auth"
 	"github.com/sapcc/image-migration-dashboard/internal/core"
+	"github.com/sapcc/image-migration-dashboard/internal/webhook"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc" // load the auth plugin
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-var db core.Database
+var (
+	db     core.Database
+	config Configuration
+	// only set if the admission webhook is enabled
+	admissionStats *webhook.Stats
+	scans          *scanAPI
+	// only set if namespace RBAC is enabled
+	namespaceAuthorizer *auth.NamespaceAuthorizer
+)
 
 func fatalIfErr(err error) {
 	if err != nil {
@@ -43,112 +57,485 @@ func fatalIfErr(err error) {
 }
 
 func main() {
-	inCluster := flag.Bool("in-cluster", false, "specify whether the application is running inside of k8s cluster")
-	var kubeconfig *string
+	// subcommands have their own set of flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan-manifests":
+			runScanManifests(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "reclassify":
+			runReclassify(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		}
+	}
+
+	viewer := flag.Bool("viewer", false,
+		"serve the history from Swift without accessing a cluster; no scans are done, and no kubeconfig is needed")
+	kubeFlags := registerKubeFlags(flag.CommandLine)
+	fixture := flag.String("fixture", "",
+		"(optional) path to a YAML/JSON file with pods that are served instead of a real cluster; nothing is stored in Swift")
+	terminatedPods := flag.String("terminated-pods", string(core.TerminatedPodsSeparate),
+		"how to handle pods in the Succeeded or Failed phase: \"separate\" (report their images separately), \"exclude\" or \"include\"")
+	includeNamespaces := flag.String("include-namespaces", "",
+		"(optional) comma-separated list of namespaces (shell glob patterns) to scan; all namespaces are scanned if empty")
+	excludeNamespaces := flag.String("exclude-namespaces", "",
+		"(optional) comma-separated list of namespaces (shell glob patterns) to exclude from the scan, e.g. \"kube-*\"")
+	podSelector := flag.String("pod-selector", "", "(optional) label selector for the pods to scan")
+	scanTimeout := flag.Duration("scan-timeout", 10*time.Minute, "maximum duration of a single cluster scan attempt")
+	scanRateLimit := flag.Duration("scan-rate-limit", 5*time.Minute,
+		"minimum time between two on-demand scans; on-demand scans require the bearer token in $IMAGE_MIGRATION_DASHBOARD_API_TOKEN or a user with scan access")
+	scanRetries := flag.Int("scan-retries", 3, "number of times that a failed cluster scan is retried (with exponential backoff)")
+	webhookListenAddr := flag.String("webhook-listen-address", "",
+		"(optional) address for serving the admission webhook via HTTPS, e.g. \":8443\"; the webhook is disabled if empty")
+	webhookCert := flag.String("webhook-tls-cert", "", "path to the TLS certificate for the admission webhook")
+	webhookKey := flag.String("webhook-tls-key", "", "path to the TLS private key for the admission webhook")
+	webhookPolicy := flag.String("webhook-policy", "", "path to the policy file (YAML or JSON) for the admission webhook")
+	webhookDryRun := flag.Bool("webhook-dry-run", false, "never deny pods in the admission webhook, only count would-be denials")
+	webhookRewrites := flag.String("webhook-rewrites", "",
+		"(optional) path to a file (YAML or JSON) with rules for rewriting Quay images to Keppel in the mutating admission webhook")
+	webhookNamespaceSelector := flag.String("webhook-namespace-selector", "image-migration-dashboard/auto-migrate=true",
+		"label selector for namespaces whose pods are mutated by the mutating admission webhook")
+	configFlags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	var err error
+	config, err = configFlags.load()
+	fatalIfErr(err)
+
+	db.ScanOptions.TerminatedPods, err = core.ParseTerminatedPodsMode(*terminatedPods)
+	fatalIfErr(err)
+	db.ScanOptions.IncludeNamespaces, err = core.ParsePatternList(*includeNamespaces)
+	fatalIfErr(err)
+	db.ScanOptions.ExcludeNamespaces, err = core.ParsePatternList(*excludeNamespaces)
+	fatalIfErr(err)
+	if *podSelector != "" {
+		db.ScanOptions.PodSelector, err = labels.Parse(*podSelector)
+		fatalIfErr(err)
+	}
+	db.ScanOptions.Timeout = *scanTimeout
+	db.ScanOptions.Retries = *scanRetries
+	db.ScanOptions.ShutdownGracePeriod = time.Duration(config.ShutdownTimeout)
+
+	if *viewer {
+		// these features require access to the cluster, or write to Swift
+		switch {
+		case *fixture != "":
+			logg.Fatal("--viewer cannot be combined with --fixture")
+		case *webhookListenAddr != "":
+			logg.Fatal("--viewer cannot be combined with --webhook-listen-address")
+		case config.Auth.NamespaceRBAC:
+			logg.Fatal("--viewer cannot be combined with auth.namespace_rbac")
+		case config.LeaderElection.LeaseName != "":
+			logg.Fatal("--viewer cannot be combined with leader election")
+		case config.SpoolDir != "":
+			logg.Fatal("--viewer cannot be combined with spool_dir")
+		}
+	}
+
+	var (
+		validator *webhook.Validator
+		mutator   *webhook.Mutator
+	)
+	if *webhookListenAddr != "" {
+		if *webhookCert == "" || *webhookKey == "" {
+			logg.Fatal("--webhook-listen-address requires --webhook-tls-cert and --webhook-tls-key")
+		}
+		if *webhookPolicy == "" && *webhookRewrites == "" {
+			logg.Fatal("--webhook-listen-address requires --webhook-policy and/or --webhook-rewrites")
+		}
+		admissionStats = webhook.NewStats()
+		if *webhookPolicy != "" {
+			policy, err := core.ReadPolicy(*webhookPolicy)
+			fatalIfErr(err)
+			validator = &webhook.Validator{Policy: policy, DryRun: *webhookDryRun, Stats: admissionStats}
+		}
+		if *webhookRewrites != "" {
+			rewrites, err := webhook.ReadRewriteRules(*webhookRewrites)
+			fatalIfErr(err)
+			selector, err := labels.Parse(*webhookNamespaceSelector)
+			fatalIfErr(err)
+			//Clientset is filled in below
+			mutator = &webhook.Mutator{Rewrites: rewrites, NamespaceSelector: selector, Stats: admissionStats}
+		}
+	}
+
+	var clientset kubernetes.Interface
+	db.DailyResults = make(map[string]core.ScanResult)
+	db.LastScrapeTime = time.Now().UTC()
+	switch {
+	case *viewer:
+		// viewer mode: only read from Swift
+		db.Storage, err = core.NewSwiftStorage(config.Swift)
+		fatalIfErr(err)
+	case *fixture != "":
+		// demo mode: use a fake cluster and do not persist anything
+		clientset, err = core.NewFixtureClientset(*fixture)
+		fatalIfErr(err)
+		db.Storage = &core.MemoryStorage{}
+	default:
+		clientset, err = kubeFlags.clientset()
+		fatalIfErr(err)
+
+		db.Storage, err = core.NewSwiftStorage(config.Swift)
+		fatalIfErr(err)
+		if config.SpoolDir != "" {
+			db.Spool, err = core.NewSpool(config.SpoolDir)
+			fatalIfErr(err)
+		}
+	}
+
+	// all components share this context, which is cancelled on SIGINT or
+	// SIGTERM; the history is loaded by the collector (or by the viewer),
+	// while the readiness probe reports that we are not ready yet
+	ctx := httpee.ContextWithSIGINT(context.Background())
+	var (
+		scanner      *core.Scanner
+		election     *core.LeaderElection
+		stopElection = func() {}
+	)
+	collectorDone := make(chan struct{})
+	if *viewer {
+		go func() {
+			defer close(collectorDone)
+			runViewer(ctx, &db)
+		}()
+	} else {
+		scanner = core.NewScanner(ctx, &db, clientset)
+		var becameLeader <-chan struct{}
+		election, becameLeader, stopElection = startLeaderElection(clientset)
+		go func() {
+			defer close(collectorDone)
+			runCollector(ctx, &db, scanner, becameLeader)
+		}()
+	}
+
+	if validator != nil || mutator != nil {
+		mux := http.NewServeMux()
+		if validator != nil {
+			mux.Handle("/validate", validator)
+		}
+		if mutator != nil {
+			mutator.Clientset = clientset
+			mux.Handle("/mutate", mutator)
+		}
+		go func() {
+			logg.Info("serving admission webhook on " + *webhookListenAddr)
+			err := listenAndServeTLSContext(ctx, *webhookListenAddr, *webhookCert, *webhookKey, mux)
+			if err != nil {
+				logg.Fatal(err.Error())
+			}
+		}()
+	}
+
+	var authenticator *auth.Authenticator
+	if config.Auth.Enabled() {
+		var identity *gophercloud.ServiceClient
+		if config.Auth.Keystone != nil {
+			identity, err = newIdentityClient()
+			fatalIfErr(err)
+		}
+		var sessionKey []byte
+		if config.Auth.OIDC != nil {
+			sessionKey = []byte(config.Auth.OIDC.SessionKey)
+		}
+		authenticator, err = auth.NewAuthenticator(ctx, config.Auth, identity, sessionKey)
+		fatalIfErr(err)
+		authenticator.RegisterHandlers(http.DefaultServeMux)
+		if config.Auth.NamespaceRBAC {
+			namespaceAuthorizer = auth.NewNamespaceAuthorizer(clientset)
+		}
+	}
+	//require the given access if authentication is enabled
+	protect := func(access auth.Access, handler http.HandlerFunc) http.Handler {
+		if authenticator == nil {
+			return handler
+		}
+		return authenticator.Require(access, handler)
+	}
+
+	http.Handle("/donut.png", protect(auth.AccessView, handleGetDonutChart))
+	http.Handle("/graph.png", protect(auth.AccessView, handleGetGraph))
+	if scanner != nil {
+		scans = &scanAPI{
+			Scanner:     scanner,
+			Token:       os.Getenv("IMAGE_MIGRATION_DASHBOARD_API_TOKEN"),
+			Auth:        authenticator,
+			MinInterval: *scanRateLimit,
+		}
+		if election != nil {
+			scans.IsLeader = election.IsLeader
+		}
+		http.Handle("/api/scan", scans)
+	} else {
+		http.HandleFunc("/api/scan", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "scans are not available in viewer mode", http.StatusNotFound)
+		})
+	}
+	http.Handle("/debug/config", protect(auth.AccessDebug, handleGetConfig))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.Handle("/", protect(auth.AccessView, handleHomePage))
+	logg.Info("listening on " + config.ListenAddress)
+	if config.TLS.CertFile != "" {
+		err = listenAndServeTLSContext(ctx, config.ListenAddress, config.TLS.CertFile, config.TLS.KeyFile, http.DefaultServeMux)
+	} else {
+		err = httpee.ListenAndServeContext(ctx, config.ListenAddress, nil)
+	}
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+
+	// the HTTP server only returns without error on shutdown; let a running
+	// scan finish saving its result before exiting (it is cancelled after the
+	// shutdown timeout)
+	logg.Info("shutting down: waiting for the collector to stop")
+	<-collectorDone
+	if scanner != nil {
+		scanner.Wait()
+	}
+	if db.Spool != nil && db.Spool.Depth() > 0 {
+		flushCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+		err := db.FlushSpool(flushCtx)
+		cancel()
+		if err != nil {
+			logg.Error("%d scans remain in the spool and will be uploaded after the restart: %s", db.Spool.Depth(), err.Error())
+		}
+	}
+	stopElection()
+	logg.Info("shutdown complete")
+}
+
+// startLeaderElection takes part in the leader election if it is enabled.
+// The returned channel is closed when this replica becomes the leader (right
+// away if leader election is disabled). The returned function releases the
+// lease.
+func startLeaderElection(clientset kubernetes.Interface) (*core.LeaderElection, <-chan struct{}, func()) {
+	becameLeader := make(chan struct{})
+	cfg := config.LeaderElection
+	if cfg.LeaseName == "" {
+		close(becameLeader)
+		return nil, becameLeader, func() {}
+	}
+
+	identity, err := os.Hostname()
+	fatalIfErr(err)
+	election := newLeaderElection(clientset, config, identity)
+	// the election has its own context, so that the lease is only released
+	// after the shutdown is complete
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := election.Run(ctx,
+			func() {
+				logg.Info("became leader as %s", identity)
+				close(becameLeader)
+			},
+			func() {
+				//exit immediately, so that we never write to storage concurrently
+				//with the new leader
+				logg.Fatal("lost the leader lease %s/%s", cfg.Namespace, cfg.LeaseName)
+			},
+		)
+		fatalIfErr(err)
+	}()
+	return election, becameLeader, func() {
+		cancel()
+		<-done
+	}
+}
+
+// newLeaderElection prepares the leader election with the settings from the
+// given configuration.
+func newLeaderElection(clientset kubernetes.Interface, cfg Configuration, identity string) *core.LeaderElection {
+	return &core.LeaderElection{
+		Clientset:     clientset,
+		Namespace:     cfg.LeaderElection.Namespace,
+		LeaseName:     cfg.LeaderElection.LeaseName,
+		Identity:      identity,
+		LeaseDuration: time.Duration(cfg.LeaderElection.LeaseDuration),
+		RenewDeadline: time.Duration(cfg.LeaderElection.RenewDeadline),
+		RetryPeriod:   time.Duration(cfg.LeaderElection.RetryPeriod),
+	}
+}
+
+// kubeFlags holds the flags for accessing the cluster.
+type kubeFlags struct {
+	inCluster  *bool
+	kubeconfig *string
+}
+
+// registerKubeFlags registers the flags for accessing the cluster in the given
+// FlagSet.
+func registerKubeFlags(fs *flag.FlagSet) kubeFlags {
+	kf := kubeFlags{
+		inCluster: fs.Bool("in-cluster", false, "specify whether the application is running inside of k8s cluster"),
+	}
 	if h := os.Getenv("HOME"); h != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(h, ".kube", "config"),
+		kf.kubeconfig = fs.String("kubeconfig", filepath.Join(h, ".kube", "config"),
 			"(optional) absolute path to the kubeconfig file")
 	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+		kf.kubeconfig = fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
-	flag.Parse()
+	return kf
+}
 
+// clientset connects to the cluster as specified by the flags.
+func (kf kubeFlags) clientset() (kubernetes.Interface, error) {
 	var (
-		config *rest.Config
-		err    error
+		restConfig *rest.Config
+		err        error
 	)
-	if *inCluster {
-		config, err = rest.InClusterConfig()
+	if *kf.inCluster {
+		restConfig, err = rest.InClusterConfig()
 	} else {
 		// use the current context in kubeconfig to build config
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		restConfig, err = clientcmd.BuildConfigFromFlags("", *kf.kubeconfig)
 	}
-	fatalIfErr(err)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
 
-	// create the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	fatalIfErr(err)
+// newIdentityClient returns a client for Keystone, using the credentials
+// from the usual OS_* environment variables.
+func newIdentityClient() (*gophercloud.ServiceClient, error) {
+	provider, err := clientconfig.AuthenticatedClient(nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize openstack client: %s", err.Error())
+	}
+	return openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
+}
 
-	// populate database using the backups from Swift
-	db.DailyResults = make(map[string]core.ScanResult)
-	db.LastScrapeTime = time.Now()
+// listenAndServeTLSContext is like httpee.ListenAndServeContext, but serves
+// HTTPS using the given certificate and private key.
+func listenAndServeTLSContext(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServeTLS(certFile, keyFile)
+	}()
 
-	acc, err := core.GetObjectStoreAccount()
-	fatalIfErr(err)
-	cntr, err := acc.Container(core.SwiftContainerName).EnsureExists()
-	fatalIfErr(err)
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
 
-	iter := cntr.Objects()
-	err = iter.Foreach(func(o *schwift.Object) error {
-		b, err := o.Download(nil).AsByteSlice()
-		if err != nil {
-			return err
+// historyRetryInterval is the delay between attempts to load the history from
+// storage.
+const historyRetryInterval = 30 * time.Second
+
+// loadHistory populates the database using the backups from storage, and
+// retries until this succeeds or the given context expires.
+func loadHistory(ctx context.Context, db *core.Database) bool {
+	for {
+		err := db.LoadHistory()
+		if err == nil {
+			return true
 		}
+		logg.Error("could not load history from storage, retrying in %s: %s", historyRetryInterval, err.Error())
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(historyRetryInterval):
+		}
+	}
+}
 
-		if o.Name() == "image_data" {
-			var data struct {
-				Images core.ImageReport `json:"images"`
-			}
-			if err = json.Unmarshal(b, &data); err == nil {
-				db.RW.Lock()
-				db.Images = data.Images
-				db.RW.Unlock()
-			}
-		} else {
-			var data core.ScanResult
-			if err = json.Unmarshal(b, &data); err == nil {
-				db.RW.Lock()
-				t := time.Unix(data.ScrapedAt, 0)
-				db.LastScrapeTime = t
-				db.DailyResults[t.Format(core.ISODateFormat)] = data
-				db.RW.Unlock()
+// refreshHistory re-reads the history from storage periodically until stop
+// is closed (forever if stop is nil). Returns false if the given context
+// expires first.
+func refreshHistory(ctx context.Context, db *core.Database, stop <-chan struct{}) bool {
+	ticker := time.NewTicker(time.Duration(config.Scan.RefreshInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-stop:
+			return true
+		case <-ticker.C:
+			err := db.LoadHistory()
+			if err != nil {
+				logg.Error("could not refresh history from storage: %s", err.Error())
 			}
 		}
+	}
+}
 
-		return err
-	})
-	fatalIfErr(err)
+// runViewer populates the database from storage, and keeps it up to date
+// with the scans saved by other instances of the dashboard.
+func runViewer(ctx context.Context, db *core.Database) {
+	if !loadHistory(ctx, db) {
+		return
+	}
+	logg.Info("viewer mode: refreshing the history from storage every %s", config.Scan.RefreshInterval)
+	refreshHistory(ctx, db, nil)
+}
+
+func runCollector(ctx context.Context, db *core.Database, scanner *core.Scanner, becameLeader <-chan struct{}) {
+	if !loadHistory(ctx, db) {
+		return
+	}
+	select {
+	case <-becameLeader:
+	default:
+		// followers serve the history from storage until they become the leader
+		logg.Info("waiting to become leader; refreshing the history from storage every %s", config.Scan.RefreshInterval)
+		if !refreshHistory(ctx, db, becameLeader) {
+			return
+		}
+		//the previous leader may have saved a scan since the last refresh
+		if !loadHistory(ctx, db) {
+			return
+		}
+	}
+
+	go db.RunUploader(ctx)
 
 	db.RW.RLock()
 	dbPopulated := len(db.DailyResults)+len(db.Images.Keppel)+
 		len(db.Images.Quay)+len(db.Images.DockerHub)+len(db.Images.Misc) > 0
 	db.RW.RUnlock()
-
 	if dbPopulated {
-		logg.Info("successfully populated the database from Swift backups")
+		logg.Info("successfully populated the database from backups")
 	} else {
-		logg.Info("could not populate the database from Swift since no data found")
+		logg.Info("could not populate the database from backups since no data found")
 		// do the initial scan
-		err := db.ScanCluster(clientset)
-		if err != nil {
-			logg.Error("cluster scan unsuccessful: %s", err.Error())
-		}
+		scanner.Trigger("startup")
+		scanner.Wait()
 	}
 
-	go runCollector(&db, clientset)
-
-	listenAddr := ":80"
-	http.HandleFunc("/donut.png", handleGetDonutChart)
-	http.HandleFunc("/graph.png", handleGetGraph)
-	http.HandleFunc("/", handleHomePage)
-	logg.Info("listening on " + listenAddr)
-	err = httpee.ListenAndServeContext(httpee.ContextWithSIGINT(context.Background()), listenAddr, nil)
-	if err != nil {
-		logg.Fatal(err.Error())
-	}
-}
-
-func runCollector(db *core.Database, clientset *kubernetes.Clientset) {
-	ticker := time.Tick(30 * time.Minute)
-	for range ticker {
+	ticker := time.NewTicker(time.Duration(config.Scan.CheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		db.RW.RLock()
 		t := db.LastScrapeTime
 		db.RW.RUnlock()
-		if time.Since(t) > 6*time.Hour {
-			err := db.ScanCluster(clientset)
-			if err != nil {
-				logg.Error("cluster scan unsuccessful: %s", err.Error())
-			}
+		if time.Since(t) > time.Duration(config.Scan.Interval) {
+			scanner.Trigger("schedule")
+			scanner.Wait()
 		}
 	}
 }
@@ -0,0 +1,78 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func TestRunViewer(t *testing.T) {
+	config = defaultConfiguration()
+	config.Scan.RefreshInterval = duration(10 * time.Millisecond)
+	defer func() { config = defaultConfiguration() }()
+
+	storage := &core.MemoryStorage{}
+	testDB := &core.Database{
+		DailyResults: make(map[string]core.ScanResult),
+		Storage:      storage,
+	}
+	day1 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := storage.Save(context.Background(), core.ScanResult{ScrapedAt: day1.Unix()}, &core.ImageReport{}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runViewer(ctx, testDB)
+	}()
+
+	//the viewer loads the history, and picks up scans saved by another instance
+	waitForScrapeTime(t, testDB, day1)
+	day2 := day1.Add(24 * time.Hour)
+	err = storage.Save(context.Background(), core.ScanResult{ScrapedAt: day2.Unix()}, &core.ImageReport{}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForScrapeTime(t, testDB, day2)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("viewer did not stop")
+	}
+}
+
+func waitForScrapeTime(t *testing.T, testDB *core.Database, expected time.Time) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		testDB.RW.RLock()
+		actual := testDB.LastScrapeTime
+		testDB.RW.RUnlock()
+		if actual.Equal(expected) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("database was not refreshed to the scan from %s", expected)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func runScanManifests(args []string) {
+	fs := flag.NewFlagSet("scan-manifests", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s scan-manifests [options] <dir-or-file>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Reports the images used by all pod specs in YAML/JSON manifests. Use \"-\" to read from stdin.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "output format (\"text\" or \"json\")")
+	namespace := fs.String("namespace", "default", "namespace for objects that do not specify one")
+	skipInvalid := fs.Bool("skip-invalid", false, "skip files that cannot be parsed instead of failing")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" {
+		logg.Fatal("unknown output format: %q", *format)
+	}
+
+	report, err := core.ScanManifests(fs.Args(), *namespace, *skipInvalid)
+	fatalIfErr(err)
+
+	if *format == "json" {
+		err = printJSON(os.Stdout, report)
+	} else {
+		err = printImageReport(os.Stdout, report)
+	}
+	fatalIfErr(err)
+}
+
+func printJSON(w io.Writer, data interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+func printImageReport(w io.Writer, report core.ImageReport) error {
+	var result core.ScanResult
+	result.CountImages(report)
+	n := result.NoOfImages
+	_, err := fmt.Fprintf(w, "%d Quay + %d Keppel + %d Docker Hub + %d Misc = %d images\n",
+		n.Quay, n.Keppel, n.DockerHub, n.Misc, n.Total)
+	if err != nil {
+		return err
+	}
+
+	for _, reg := range core.AllRegistries {
+		images := report.Get(reg)
+		if len(images) == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "\nImages coming from %s:\n", reg.DisplayName())
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			_, err := fmt.Fprintf(w, "  %s\n", img.Name)
+			if err != nil {
+				return err
+			}
+			for _, c := range img.Containers {
+				line := "    - " + c.Name
+				if c.Source != "" {
+					line += " (" + c.Source + ")"
+				}
+				_, err := fmt.Fprintln(w, line)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var spoolDepthGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "image_migration_dashboard_spool_depth",
+		Help: "Number of scans in the local spool that are waiting to be uploaded to Swift.",
+	},
+	func() float64 {
+		if db.Spool == nil {
+			return 0
+		}
+		return float64(db.Spool.Depth())
+	},
+)
+
+func init() {
+	prometheus.MustRegister(spoolDepthGauge)
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+)
+
+func runReclassify(args []string) {
+	fs := flag.NewFlagSet("reclassify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reclassify [--dry-run] [options]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Rebuilds the scan results and the image report of all scans in Swift from their raw data,")
+		fmt.Fprintln(fs.Output(), "using the current classification rules, and prints the changed counts. Scans from versions")
+		fmt.Fprintln(fs.Output(), "that did not store raw data are left unchanged.")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "If leader election is configured, the leader lease is held while the scans are rewritten, so")
+		fmt.Fprintln(fs.Output(), "that no replica of the dashboard writes to Swift at the same time. Otherwise, stop the")
+		fmt.Fprintln(fs.Output(), "dashboard first.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	dryRun := fs.Bool("dry-run", false, "only print the changes, do not save them")
+	leaseTimeout := fs.Duration("lease-timeout", time.Minute,
+		"maximum time to wait for the leader lease (only if leader election is configured)")
+	kubeFlags := registerKubeFlags(fs)
+	configFlags := registerConfigFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := configFlags.load()
+	fatalIfErr(err)
+	storage, err := core.NewSwiftStorage(cfg.Swift)
+	fatalIfErr(err)
+
+	release := func() {}
+	if !*dryRun {
+		release, err = acquireLeaseIfConfigured(cfg, kubeFlags, "reclassify", *leaseTimeout)
+		fatalIfErr(err)
+	}
+	err = reclassify(context.Background(), storage, os.Stdout, *dryRun)
+	release()
+	fatalIfErr(err)
+}
+
+// acquireLeaseIfConfigured acquires the leader lease with acquireLease for the
+// given command, if leader election is configured. The returned function
+// releases the lease.
+func acquireLeaseIfConfigured(cfg Configuration, kf kubeFlags, command string, timeout time.Duration) (func(), error) {
+	if cfg.LeaderElection.LeaseName == "" {
+		return func() {}, nil
+	}
+	clientset, err := kf.clientset()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	//the suffix keeps us apart from a replica on the same host (e.g. when
+	//running in its pod with "kubectl exec")
+	election := newLeaderElection(clientset, cfg, hostname+"-"+command)
+	return acquireLease(election, timeout)
+}
+
+// acquireLease waits until the given election is won, so that no replica of
+// the dashboard scans and writes to storage in the meantime. It fails if the
+// lease is not acquired within the given timeout, e.g. because the leader is
+// still running. The returned function releases the lease.
+func acquireLease(election *core.LeaderElection, timeout time.Duration) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := election.Run(ctx,
+			func() { close(acquired) },
+			func() {
+				//exit immediately, so that we never write to storage concurrently
+				//with the new leader
+				logg.Fatal("lost the leader lease %s/%s", election.Namespace, election.LeaseName)
+			},
+		)
+		fatalIfErr(err)
+	}()
+	release := func() {
+		cancel()
+		<-done
+	}
+
+	select {
+	case <-acquired:
+		return release, nil
+	case <-time.After(timeout):
+		release()
+		return nil, fmt.Errorf("could not acquire the leader lease %s/%s within %s, stop the dashboard first",
+			election.Namespace, election.LeaseName, timeout)
+	}
+}
+
+// reclassify rebuilds all scans in the given storage that have raw data, and
+// prints the counts that changed.
+func reclassify(ctx context.Context, storage core.Storage, w io.Writer, dryRun bool) error {
+	current := core.Database{DailyResults: make(map[string]core.ScanResult)}
+	err := storage.Load(&current)
+	if err != nil {
+		return fmt.Errorf("could not load history: %s", err.Error())
+	}
+
+	rebuilt, changed := 0, 0
+	err = core.Reclassify(storage, current.Images, func(raw core.RawScan, result core.ScanResult, images core.ImageReport) error {
+		rebuilt++
+		date := time.Unix(raw.ScrapedAt, 0).UTC().Format(core.ISODateFormat)
+		if changes := describeCountChanges(current.DailyResults[date], result); len(changes) > 0 {
+			changed++
+			fmt.Fprintf(w, "%s: %s\n", date, strings.Join(changes, ", "))
+		}
+		if dryRun {
+			return nil
+		}
+		//the raw data is unchanged, so it is not uploaded again
+		return storage.Save(ctx, result, &images, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("could not reclassify scans: %s", err.Error())
+	}
+
+	verb := "rebuilt"
+	if dryRun {
+		verb = "would be rebuilt (dry run)"
+	}
+	fmt.Fprintf(w, "%d of %d scans %s, %d with changed counts\n", rebuilt, len(current.DailyResults), verb, changed)
+	return nil
+}
+
+// describeCountChanges lists the per-registry counts that differ between two
+// scan results.
+func describeCountChanges(before, after core.ScanResult) []string {
+	var changes []string
+	for _, c := range []struct {
+		Name          string
+		Before, After core.Counts
+	}{
+		{"images", before.NoOfImages, after.NoOfImages},
+		{"containers", before.NoOfContainers, after.NoOfContainers},
+		{"pods", before.NoOfPods, after.NoOfPods},
+		{"running containers", before.NoOfRunningContainers, after.NoOfRunningContainers},
+	} {
+		for _, reg := range core.AllRegistries {
+			if b, a := c.Before.Get(reg), c.After.Get(reg); b != a {
+				changes = append(changes, fmt.Sprintf("%s from %s: %d -> %d", c.Name, reg.DisplayName(), b, a))
+			}
+		}
+	}
+	return changes
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 SAP SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/image-migration-dashboard/internal/core"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReclassify(t *testing.T) {
+	scrapedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	date := scrapedAt.Format(core.ISODateFormat)
+	raw := core.RawScan{
+		ScrapedAt: scrapedAt.Unix(),
+		Containers: []core.RawContainer{
+			{Name: "monsoon3/app-1/app", Image: "keppel.eu-de-1.cloud.sap/ccloud/app:1"},
+		},
+	}
+	//the stored result was classified with outdated rules
+	outdated := core.ScanResult{
+		ScrapedAt:      raw.ScrapedAt,
+		NoOfImages:     core.Counts{Total: 1, Misc: 1},
+		NoOfContainers: core.Counts{Total: 1, Misc: 1},
+		NoOfPods:       core.Counts{Total: 1, Misc: 1},
+	}
+	storage := &rawCountingStorage{MemoryStorage: &core.MemoryStorage{}}
+	err := storage.Save(context.Background(), outdated, &core.ImageReport{}, &raw)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//scans without raw data are not touched
+	legacy := core.ScanResult{ScrapedAt: raw.ScrapedAt - 86400}
+	storage.DailyResults[time.Unix(legacy.ScrapedAt, 0).UTC().Format(core.ISODateFormat)] = legacy
+
+	expectedChanges := fmt.Sprintf("%s: images from Keppel: 0 -> 1, images from Misc.: 1 -> 0, "+
+		"containers from Keppel: 0 -> 1, containers from Misc.: 1 -> 0, "+
+		"pods from Keppel: 0 -> 1, pods from Misc.: 1 -> 0, running containers from Keppel: 0 -> 1\n", date)
+
+	var out bytes.Buffer
+	err = reclassify(context.Background(), storage, &out, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "dry run output", out.String(),
+		expectedChanges+"1 of 2 scans would be rebuilt (dry run), 1 with changed counts\n")
+	assert.DeepEqual(t, "result after dry run", storage.DailyResults[date], outdated)
+
+	out.Reset()
+	err = reclassify(context.Background(), storage, &out, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "output", out.String(), expectedChanges+"1 of 2 scans rebuilt, 1 with changed counts\n")
+	assert.DeepEqual(t, "images after reclassify", storage.DailyResults[date].NoOfImages, core.Counts{Total: 1, Keppel: 1})
+	assert.DeepEqual(t, "image report after reclassify", len(storage.Images.Keppel), 1)
+	//the raw data is kept, but not uploaded again
+	assert.DeepEqual(t, "raw data after reclassify", storage.RawScans[date], raw)
+	assert.DeepEqual(t, "raw data uploads", storage.RawSaves, 1)
+}
+
+// rawCountingStorage is a MemoryStorage that counts how often raw data is
+// saved.
+type rawCountingStorage struct {
+	*core.MemoryStorage
+	RawSaves int
+}
+
+func (s *rawCountingStorage) Save(ctx context.Context, result core.ScanResult, images *core.ImageReport, raw *core.RawScan) error {
+	if raw != nil {
+		s.RawSaves++
+	}
+	return s.MemoryStorage.Save(ctx, result, images, raw)
+}
+
+func TestReclassifyAcquiresLease(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	var cfg Configuration
+	cfg.LeaderElection.LeaseName = "image-migration-dashboard"
+	cfg.LeaderElection.Namespace = "dashboard"
+	cfg.LeaderElection.LeaseDuration = duration(2 * time.Second)
+	cfg.LeaderElection.RenewDeadline = duration(time.Second)
+	cfg.LeaderElection.RetryPeriod = duration(100 * time.Millisecond)
+
+	//while the dashboard holds the lease, reclassify gives up
+	leader := newLeaderElection(clientset, cfg, "replica-a")
+	ctx, cancel := context.WithCancel(context.Background())
+	leading := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := leader.Run(ctx, func() { close(leading) }, func() {})
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	<-leading
+	_, err := acquireLease(newLeaderElection(clientset, cfg, "replica-a-reclassify"), 500*time.Millisecond)
+	assert.DeepEqual(t, "error while the dashboard is leader", err.Error(),
+		"could not acquire the leader lease dashboard/image-migration-dashboard within 500ms, stop the dashboard first")
+
+	//once the dashboard is stopped, the lease is acquired right away
+	cancel()
+	<-done
+	election := newLeaderElection(clientset, cfg, "replica-a-reclassify")
+	release, err := acquireLease(election, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "reclassify is leader", election.IsLeader(), true)
+	release()
+	assert.DeepEqual(t, "reclassify is leader after release", election.IsLeader(), false)
+}
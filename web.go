@@ -16,17 +16,27 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"net/http"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/image-migration-dashboard/internal/auth"
 	"github.com/sapcc/image-migration-dashboard/internal/core"
+	"github.com/sapcc/image-migration-dashboard/internal/webhook"
 	"github.com/wcharczuk/go-chart"
 )
 
-var homePageTemplate = template.Must(template.New("homepage").Parse(`
+var homePageTemplate = template.Must(template.New("homepage").Funcs(template.FuncMap{
+	"formatDate": formatDate,
+	"formatAge":  formatAge,
+	"registryOf": func(image string) string {
+		return core.ClassifyImage(image).DisplayName()
+	},
+}).Parse(`
 <!doctype html>
 <html class="no-js" lang="en">
 
@@ -53,6 +63,23 @@ var homePageTemplate = template.Must(template.New("homepage").Parse(`
 			margin-bottom: 0.25em;
 			line-height: 1.2;
 		}
+
+		span.seen {
+			color: #888;
+			font-size: 0.85em;
+		}
+
+		p.banner {
+			margin-top: 1em;
+			padding: 0.5em 1em;
+			border: 1px solid #c33;
+			background-color: #fee;
+		}
+
+		span.mismatch {
+			color: #c33;
+			font-size: 0.85em;
+		}
 	</style>
 </head>
 
@@ -60,50 +87,280 @@ var homePageTemplate = template.Must(template.New("homepage").Parse(`
 	<div class="container">
 		<section class="header">
 			<h2 class="title" style="text-align: center;">Image Migration Dashboard</h2>
+			{{ with .User }}{{ if eq .Method "oidc" }}
+			<p style="text-align: right;">Logged in as {{ .Name }} (<a href="/auth/logout">log out</a>)</p>
+			{{ end }}{{ end }}
 		</section>
 	</div>
 
+	{{ with .Status }}
+	<!-- Scan status container -->
+	<div class="container">
+		{{ if .Stale }}
+		<p class="banner">
+			The data shown here is stale: the last successful scan was on {{ formatDate .LastScrapeTime.Unix }}.
+		</p>
+		{{ end }}
+		{{ with .FailedAttempt }}
+		<p class="banner">
+			The last scan attempt at {{ .StartedAt.UTC.Format "2006-01-02 15:04:05 MST" }} failed after {{ .Duration }} ({{ .PodsSeen }} pods seen): {{ .Error }}
+		</p>
+		{{ end }}
+		{{ if .SpoolDepth }}
+		<p class="banner">
+			{{ .SpoolDepth }} scan(s) could not be uploaded to Swift yet and are kept in the local spool{{ with .UploadError }}: {{ . }}{{ end }}
+		</p>
+		{{ end }}
+	</div>
+	{{ end }}
+
 	<div class="container wide">
 		<div class="row">
 			<!-- Image usage over time container -->
 			<div class="nine columns">
 				<h4>Image sources over time</h4>
-				<img class="u-max-full-width" src="/graph.png">
+				<img class="u-max-full-width" src="/graph.png?weight={{ .Weight }}">
 			</div>
 
 			<!-- Image distribution container -->
 			<div class="three columns">
 				<h4>As of today</h4>
-				<img class="u-max-full-width" src="/donut.png">
+				<img class="u-max-full-width" src="/donut.png?weight={{ .Weight }}">
+				<p>
+					{{- $n := .Counts -}}
+					{{$n.Quay}} Quay + {{$n.Keppel}} Keppel + {{$n.DockerHub}} Docker Hub + {{$n.Misc}} Misc = {{$n.Total}} {{ .Weight.Label -}}
+				</p>
+				<p>
+					Count:
+					<a href="?weight=images&amp;sort={{ .Sort }}">unique images</a> |
+					<a href="?weight=containers&amp;sort={{ .Sort }}">containers</a> |
+					<a href="?weight=pods&amp;sort={{ .Sort }}">pods</a> |
+					<a href="?weight=running&amp;sort={{ .Sort }}">containers by running image</a>
+				</p>
+				{{ if .ScanEnabled }}
 				<p>
-					{{- $n := .LastResult.NoOfImages -}}
-					{{$n.Quay}} Quay + {{$n.Keppel}} Keppel + {{$n.DockerHub}} Docker Hub + {{$n.Misc}} Misc = {{$n.Total -}}
+					<button id="scan-button" onclick="triggerScan()">Scan now</button>
+					<span id="scan-status"></span>
 				</p>
+				{{ end }}
 			</div>
 		</div>
 	</div>
 
+	{{ if .ScanEnabled }}
+	<script>
+		function showScanStatus(status) {
+			var text = status.running
+				? "Scanning (" + status.pods_seen + " pods seen so far)..."
+				: status.error ? "Scan failed: " + status.error : "Scan finished.";
+			document.getElementById("scan-status").textContent = text;
+			if (status.running) {
+				setTimeout(pollScanStatus, 2000);
+			} else if (!status.error) {
+				window.location.reload();
+			}
+		}
+		function pollScanStatus() {
+			fetch("/api/scan").then(function(r) { return r.json(); }).then(showScanStatus);
+		}
+		function triggerScan() {
+			var headers = {};
+			{{ if not .CanScan }}
+			var token = sessionStorage.getItem("scan-token") || prompt("API token for on-demand scans:");
+			if (!token) {
+				return;
+			}
+			headers["Authorization"] = "Bearer " + token;
+			{{ end }}
+			fetch("/api/scan", { method: "POST", headers: headers, credentials: "same-origin" })
+				.then(function(r) {
+					if (r.status === 202) {
+						{{ if not .CanScan }}sessionStorage.setItem("scan-token", token);{{ end }}
+						return r.json().then(showScanStatus);
+					}
+					if (r.status === 401) {
+						sessionStorage.removeItem("scan-token");
+					}
+					return r.text().then(function(text) {
+						document.getElementById("scan-status").textContent = text;
+					});
+				});
+		}
+	</script>
+	{{ end }}
+
+	{{ if or .Scope .LastResult.Exclusions }}
+	<!-- Scope container -->
+	<div class="container">
+		<hr>
+		<h4>Scope</h4>
+		{{ if .Scope }}
+		<ul>
+			{{ range $s := .Scope }}
+			<li>{{ $s }}</li>
+			{{ end }}
+		</ul>
+		{{ end }}
+		{{ with .LastResult.Exclusions }}
+		<p>These pods were excluded from the last scan and are not included in any of the counts above.</p>
+		<table class="u-full-width">
+			<thead>
+				<tr>
+					<th>Namespace</th>
+					<th>Reason</th>
+					<th>Pods</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range $e := . }}
+				<tr>
+					<td>{{ $e.Namespace }}</td>
+					<td>{{ $e.Reason }}</td>
+					<td>{{ $e.Pods }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
+	</div>
+	{{ end }}
+
+	{{ with .Admission }}
+	<!-- Admission webhook container -->
+	<div class="container">
+		<hr>
+		<h4>Admission webhook decisions since last restart</h4>
+		<table class="u-full-width">
+			<thead>
+				<tr>
+					<th>Namespace</th>
+					<th>Allowed</th>
+					<th>Warned</th>
+					<th>Denied</th>
+					<th>Would deny (dry-run)</th>
+					<th>Rewritten to Keppel</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range $ns := .Namespaces }}
+				<tr>
+					<td>{{ $ns.Namespace }}</td>
+					<td>{{ $ns.Allowed }}</td>
+					<td>{{ $ns.Warned }}</td>
+					<td>{{ $ns.Denied }}</td>
+					<td>{{ $ns.WouldDeny }}</td>
+					<td>{{ $ns.Rewritten }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ if .Events }}
+		<h5>Recent events</h5>
+		<table class="u-full-width">
+			<thead>
+				<tr>
+					<th>Time</th>
+					<th>Namespace/Pod</th>
+					<th>Decision</th>
+					<th>Details</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range $e := .Events }}
+				<tr>
+					<td>{{ $e.Time.UTC.Format "2006-01-02 15:04:05" }}</td>
+					<td>{{ $e.Namespace }}/{{ $e.Pod }}</td>
+					<td>{{ $e.Action }}</td>
+					<td>
+						<ul>
+						{{ range $m := $e.Messages }}
+							<li>{{ $m }}</li>
+						{{ end }}
+						</ul>
+					</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
+	</div>
+	{{ end }}
+
 	<!-- Images container -->
 	<div class="container">
 		<hr>
+		<p>
+			Sort images by:
+			<a href="?sort=name&amp;weight={{ .Weight }}">name</a> |
+			<a href="?sort=oldest&amp;weight={{ .Weight }}">oldest first</a> |
+			<a href="?sort=newest&amp;weight={{ .Weight }}">newest first</a>
+		</p>
+		{{ if .Filtered }}
+		<p>Only namespaces in which you can list pods are shown below. The counts above include all namespaces.</p>
+		{{ end }}
+		{{ if .Mismatches }}
+		<h4>Containers running a different image than specified</h4>
+		<table class="u-full-width">
+			<thead>
+				<tr>
+					<th>Namespace/Pod/Container</th>
+					<th style="max-width: 350px;;">Image in spec</th>
+					<th style="max-width: 350px;;">Running image</th>
+					<th>Difference</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range $m := .Mismatches }}
+				<tr>
+					<td>{{ $m.Container.Name }}</td>
+					<td style="max-width: 350px;; word-wrap: break-word;">{{ $m.SpecImage }}</td>
+					<td style="max-width: 350px;; word-wrap: break-word;">{{ $m.Container.StatusImage }}</td>
+					<td><span class="mismatch">{{ $m.Container.Mismatch }}</span></td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
+
+		{{ $now := .Now }}
+		{{ $lastScan := .LastResult.ScrapedAt }}
 		{{ range $reg := .Registries }}
+		{{/* sections with a note are only shown if they contain images */}}
+		{{ if or (not $reg.Note) $reg.Images }}
+		{{ if $reg.Note }}
+		<h4>{{ $reg.Name }}</h4>
+		<p>{{ $reg.Note }}</p>
+		{{ else }}
 		<h4>Images currently coming from {{ $reg.Name }}</h4>
+		{{ end }}
 		<table class="u-full-width">
 			<thead>
 				<tr>
 					<th style="max-width: 350px;;">Image</th>
+					<th>First seen</th>
+					<th>Last seen</th>
 					<th>Namespace/Pod/Container</th>
 				</tr>
 			</thead>
 			<tbody>
 				{{ range $img := $reg.Images }}
 				<tr>
-					<td style="max-width: 350px;; word-wrap: break-word;">{{ $img.Name }}</td>
+					<td style="max-width: 350px;; word-wrap: break-word;">
+						{{- $img.Name -}}
+						{{ if $reg.Note }}<br><span class="seen">from {{ registryOf $img.Name }}</span>{{ end }}
+					</td>
+					<td>{{ formatDate $img.FirstSeen }} <span class="seen">{{ formatAge $now $img.FirstSeen }}</span></td>
+					<td>{{ formatDate $img.LastSeen }}</td>
 					<td>
 						<ul>
 						{{ range $v := $img.Containers }}
 							<li>
-								{{ $v }}
+								{{ $v.Name }}
+								<span class="seen">since {{ formatDate $v.FirstSeen }}
+								{{- if and $v.LastSeen (lt $v.LastSeen $lastScan) }}, last seen {{ formatDate $v.LastSeen }}{{ end }}</span>
+								{{- if $v.Mismatch }}
+								<br><span class="mismatch">running {{ $v.StatusImage }}: {{ $v.Mismatch }}</span>
+								{{- end }}
 							</li>
 						{{ end }}
 						</ul>
@@ -113,6 +370,44 @@ var homePageTemplate = template.Must(template.New("homepage").Parse(`
 			</tbody>
 		</table>
 		{{ end }}
+		{{ end }}
+
+		{{ if .PullSecrets }}
+		<h4>Image pull secrets with credentials for Quay or Docker Hub</h4>
+		<table class="u-full-width">
+			<thead>
+				<tr>
+					<th>Namespace/Secret</th>
+					<th>Registries</th>
+					<th>Used by</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range $s := .PullSecrets }}
+				<tr>
+					<td>{{ $s.Name }}</td>
+					<td>
+						<ul>
+						{{ range $r := $s.Registries }}
+							<li>{{ $r }}</li>
+						{{ end }}
+						</ul>
+					</td>
+					<td>
+						<ul>
+						{{ range $v := $s.ServiceAccounts }}
+							<li>service account {{ $v }}</li>
+						{{ end }}
+						{{ range $v := $s.Workloads }}
+							<li>{{ $v }}</li>
+						{{ end }}
+						</ul>
+					</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
 
 	</div>
 </body>
@@ -127,44 +422,275 @@ func handleHomePage(w http.ResponseWriter, r *http.Request) {
 	db.RW.RLock()
 	res := db.DailyResults[db.LastScrapeTime.Format(core.ISODateFormat)]
 	images := db.Images
+	scanOptions := db.ScanOptions
+	status := scanStatus{LastScrapeTime: db.LastScrapeTime}
+	if n := len(db.ScanAttempts); n > 0 && db.ScanAttempts[n-1].Error != "" {
+		attempt := db.ScanAttempts[n-1]
+		status.FailedAttempt = &attempt
+	}
 	db.RW.RUnlock()
+	if db.Spool != nil {
+		storage := db.Health(0, time.Now()).Storage
+		status.SpoolDepth = storage.SpoolDepth
+		status.UploadError = storage.LastError
+	}
 
-	// sort everything alphabetically
+	// images are sorted alphabetically by the collector
 	var data struct {
-		LastResult core.ScanResult
+		Now         time.Time
+		Sort        string
+		Weight      weighting
+		Counts      core.Counts
+		LastResult  core.ScanResult
+		Scope       []string
+		ScanEnabled bool
+		// only set if authentication is enabled
+		User    *auth.User
+		CanScan bool
+		// whether details are filtered by the user's namespace access
+		Filtered  bool
+		Status    *scanStatus
+		Admission *struct {
+			Namespaces []webhook.NamespaceStats
+			Events     []webhook.Event
+		}
 		Registries []struct {
 			Name   string
+			Note   string
 			Images []core.Image
 		}
+		Mismatches  []core.ImageMismatch
+		PullSecrets []core.PullSecret
+	}
+	data.Now = time.Now()
+	data.User = auth.UserFromContext(r.Context())
+	if admissionStats != nil {
+		data.Admission = &struct {
+			Namespaces []webhook.NamespaceStats
+			Events     []webhook.Event
+		}{admissionStats.Namespaces(), admissionStats.RecentEvents()}
+	}
+	if data.User != nil && namespaceAuthorizer != nil {
+		//cluster-wide counts stay visible, but details are only shown for
+		//namespaces that the user can see in Kubernetes
+		namespaces := images.Namespaces()
+		for _, e := range res.Exclusions {
+			namespaces = append(namespaces, e.Namespace)
+		}
+		if data.Admission != nil {
+			for _, s := range data.Admission.Namespaces {
+				namespaces = append(namespaces, s.Namespace)
+			}
+			for _, e := range data.Admission.Events {
+				namespaces = append(namespaces, e.Namespace)
+			}
+		}
+		visible := namespaceAuthorizer.VisibleNamespaces(r.Context(), *data.User, namespaces)
+		images = images.FilterNamespaces(visible)
+		res.Exclusions = filterExclusions(res.Exclusions, visible)
+		if data.Admission != nil {
+			data.Admission.Namespaces = filterNamespaceStats(data.Admission.Namespaces, visible)
+			data.Admission.Events = filterEvents(data.Admission.Events, visible)
+		}
+		data.Filtered = true
 	}
+	data.Mismatches = images.Mismatches()
+	data.PullSecrets = images.PullSecrets
 	data.LastResult = res
+	data.Scope = describeScope(scanOptions)
+	data.CanScan = data.User != nil && scans != nil && scans.Auth != nil &&
+		data.User.Can(auth.AccessScan, scans.Auth.Config.Access)
+	data.ScanEnabled = data.CanScan || (scans != nil && scans.Token != "")
+	status.Stale = data.Now.Sub(status.LastScrapeTime) > time.Duration(config.Scan.StaleAfter)
+	if status.Stale || status.FailedAttempt != nil || status.SpoolDepth > 0 {
+		data.Status = &status
+	}
+	data.Sort = r.URL.Query().Get("sort")
+	data.Weight = parseWeighting(r)
+	data.Counts = data.Weight.Counts(res)
 	data.Registries = append(data.Registries, []struct {
 		Name   string
+		Note   string
 		Images []core.Image
 	}{
-		{"Quay", images.Quay},
-		{"Keppel", images.Keppel},
-		{"Docker Hub", images.DockerHub},
-		{"Misc.", images.Misc},
+		{"Quay", "", sortImages(images.Quay, data.Sort)},
+		{"Keppel", "", sortImages(images.Keppel, data.Sort)},
+		{"Docker Hub", "", sortImages(images.DockerHub, data.Sort)},
+		{"Misc.", "", sortImages(images.Misc, data.Sort)},
+		{"Ephemeral containers", "Images of debug containers (e.g. from 'kubectl debug'). These are not included in the counts above.",
+			sortImages(images.Ephemeral, data.Sort)},
+		{"Pods in terminal phases", "Images of pods that are Succeeded or Failed. These are not included in the counts above.",
+			sortImages(images.Terminated, data.Sort)},
+		{"Recently removed", "Images and locations that were found by scans of the last 7 days, but not by the latest scan. These are not included in the counts above.",
+			sortImages(images.Removed, data.Sort)},
 	}...)
 
 	homePageTemplate.Execute(w, data)
 }
 
+// weighting determines what is counted in the graph and the donut chart.
+type weighting string
+
+const (
+	weightImages     weighting = "images"
+	weightContainers weighting = "containers"
+	weightPods       weighting = "pods"
+	weightRunning    weighting = "running"
+)
+
+func parseWeighting(r *http.Request) weighting {
+	switch w := weighting(r.URL.Query().Get("weight")); w {
+	case weightContainers, weightPods, weightRunning:
+		return w
+	default:
+		return weightImages
+	}
+}
+
+// Counts returns the counts from the given ScanResult that match this
+// weighting.
+func (w weighting) Counts(res core.ScanResult) core.Counts {
+	switch w {
+	case weightContainers:
+		return res.NoOfContainers
+	case weightPods:
+		return res.NoOfPods
+	case weightRunning:
+		return res.NoOfRunningContainers
+	default:
+		return res.NoOfImages
+	}
+}
+
+// Label returns a human-readable name for the things counted by this
+// weighting.
+func (w weighting) Label() string {
+	switch w {
+	case weightImages:
+		return "unique images"
+	case weightRunning:
+		return "containers by running image"
+	}
+	return string(w)
+}
+
+// scanStatus is shown as a banner on the home page when the data is stale,
+// the last scan attempt failed, or scans are waiting to be uploaded.
+type scanStatus struct {
+	LastScrapeTime time.Time
+	Stale          bool
+	FailedAttempt  *core.ScanAttempt
+	SpoolDepth     int
+	UploadError    string
+}
+
+// describeScope returns a human-readable description of the ScanOptions that
+// restrict which pods are scanned.
+func describeScope(opts core.ScanOptions) []string {
+	var result []string
+	if len(opts.IncludeNamespaces) > 0 {
+		result = append(result, "Only namespaces matching: "+strings.Join(opts.IncludeNamespaces, ", "))
+	}
+	if len(opts.ExcludeNamespaces) > 0 {
+		result = append(result, "Excluding namespaces matching: "+strings.Join(opts.ExcludeNamespaces, ", "))
+	}
+	if opts.PodSelector != nil && !opts.PodSelector.Empty() {
+		result = append(result, "Only pods matching the label selector: "+opts.PodSelector.String())
+	}
+	if len(result) > 0 {
+		result = append(result, fmt.Sprintf("Pods with the annotation %s=true are excluded", core.OptOutAnnotation))
+	}
+	return result
+}
+
+// filterExclusions returns the exclusions in visible namespaces.
+func filterExclusions(exclusions []core.Exclusion, visible func(string) bool) []core.Exclusion {
+	var result []core.Exclusion
+	for _, e := range exclusions {
+		if visible(e.Namespace) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// filterNamespaceStats returns the admission stats for visible namespaces.
+func filterNamespaceStats(stats []webhook.NamespaceStats, visible func(string) bool) []webhook.NamespaceStats {
+	var result []webhook.NamespaceStats
+	for _, s := range stats {
+		if visible(s.Namespace) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// filterEvents returns the admission events in visible namespaces.
+func filterEvents(events []webhook.Event, visible func(string) bool) []webhook.Event {
+	var result []webhook.Event
+	for _, e := range events {
+		if visible(e.Namespace) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// sortImages returns a sorted copy of the given images. The input slice is
+// shared with the database and must not be modified.
+func sortImages(images []core.Image, order string) []core.Image {
+	result := make([]core.Image, len(images))
+	copy(result, images)
+	switch order {
+	case "oldest":
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].FirstSeen < result[j].FirstSeen
+		})
+	case "newest":
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].FirstSeen > result[j].FirstSeen
+		})
+	}
+	return result
+}
+
+func formatDate(unix int64) string {
+	if unix == 0 {
+		return "unknown"
+	}
+	return time.Unix(unix, 0).UTC().Format(core.ISODateFormat)
+}
+
+func formatAge(now time.Time, unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	days := int(now.Sub(time.Unix(unix, 0)).Hours() / 24)
+	switch days {
+	case 0:
+		return "(today)"
+	case 1:
+		return "(1 day ago)"
+	default:
+		return fmt.Sprintf("(%d days ago)", days)
+	}
+}
+
 // HandleGetDonutChart serves donuts.
 func handleGetDonutChart(w http.ResponseWriter, r *http.Request) {
 	db.RW.RLock()
 	res := db.DailyResults[db.LastScrapeTime.Format(core.ISODateFormat)]
 	db.RW.RUnlock()
+	counts := parseWeighting(r).Counts(res)
 
 	donut := chart.DonutChart{
 		Width:  512,
 		Height: 512,
 		Values: []chart.Value{
-			{Value: float64(res.NoOfImages.Keppel), Label: "Keppel"},
-			{Value: float64(res.NoOfImages.Quay), Label: "Quay"},
-			{Value: float64(res.NoOfImages.DockerHub), Label: "Docker Hub"},
-			{Value: float64(res.NoOfImages.Misc), Label: "Misc."},
+			{Value: float64(counts.Keppel), Label: "Keppel"},
+			{Value: float64(counts.Quay), Label: "Quay"},
+			{Value: float64(counts.DockerHub), Label: "Docker Hub"},
+			{Value: float64(counts.Misc), Label: "Misc."},
 		},
 	}
 	var b bytes.Buffer
@@ -193,12 +719,18 @@ func handleGetGraph(w http.ResponseWriter, r *http.Request) {
 		dateStrings = append(dateStrings, k)
 	}
 	sort.Strings(dateStrings)
+	weight := parseWeighting(r)
 	for _, dateString := range dateStrings {
 		v := db.DailyResults[dateString]
+		counts := weight.Counts(v)
+		//older scan results do not have container and pod counts
+		if weight != weightImages && counts.Total == 0 {
+			continue
+		}
 		ts = append(ts, time.Unix(v.ScrapedAt, 0))
-		kfs = append(kfs, float64(v.NoOfImages.Keppel))
-		qfs = append(qfs, float64(v.NoOfImages.Quay))
-		dfs = append(dfs, float64(v.NoOfImages.DockerHub))
+		kfs = append(kfs, float64(counts.Keppel))
+		qfs = append(qfs, float64(counts.Quay))
+		dfs = append(dfs, float64(counts.DockerHub))
 	}
 	db.RW.RUnlock()
 